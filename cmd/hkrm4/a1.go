@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultA1Type = 0x2714
+
+var (
+	a1TemperatureMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "a1",
+		Name:      "temperature_celsius",
+		Help:      "Temperature reported by an A1 sensor in degrees celsius.",
+	}, []string{"id"})
+
+	a1HumidityMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "a1",
+		Name:      "relative_humidity_percentage",
+		Help:      "Relative humidity reported by an A1 sensor in percent.",
+	}, []string{"id"})
+
+	a1LightMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "a1",
+		Name:      "light_level",
+		Help:      "Light level reported by an A1 sensor, from 0 (dark) to 3 (bright).",
+	}, []string{"id"})
+
+	a1AirQualityMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "a1",
+		Name:      "air_quality_level",
+		Help:      "Air quality reported by an A1 sensor, from 0 (excellent) to 3 (bad).",
+	}, []string{"id"})
+
+	a1NoiseMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "a1",
+		Name:      "noise_level",
+		Help:      "Noise level reported by an A1 sensor, from 0 (quiet) to 2 (noisy).",
+	}, []string{"id"})
+
+	a1Metrics = []*prometheus.GaugeVec{
+		a1TemperatureMetric,
+		a1HumidityMetric,
+		a1LightMetric,
+		a1AirQualityMetric,
+		a1NoiseMetric,
+	}
+)
+
+// a1Lux is a representative light level in lux for each level the A1
+// reports, as HomeKit has no notion of coarse light levels.
+var a1Lux = map[int]float64{
+	broadlink.LightDark:   1,
+	broadlink.LightDim:    50,
+	broadlink.LightNormal: 300,
+	broadlink.LightBright: 1000,
+}
+
+// a1AirQuality maps the A1's air quality levels to HomeKit's.
+var a1AirQuality = map[int]int{
+	broadlink.AirExcellent: characteristic.AirQualityExcellent,
+	broadlink.AirGood:      characteristic.AirQualityGood,
+	broadlink.AirNormal:    characteristic.AirQualityFair,
+	broadlink.AirBad:       characteristic.AirQualityPoor,
+}
+
+// a1Config is a Broadlink A1 environmental sensor. Like a plug it is a
+// device of its own rather than something driven through the hub.
+type a1Config struct {
+	ID   string `json:"id" yaml:"id" toml:"id"`
+	Name string `json:"name" yaml:"name" toml:"name"`
+
+	IP   net.IP `json:"ip" yaml:"ip" toml:"ip"`
+	MAC  string `json:"mac" yaml:"mac" toml:"mac"`
+	Type int    `json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"`
+}
+
+func (a *a1Config) validate() error {
+	if a.Name == "" {
+		return fmt.Errorf("has no name")
+	}
+
+	if a.IP == nil {
+		return fmt.Errorf("has no ip")
+	}
+
+	_, err := net.ParseMAC(a.MAC)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (a *a1Config) devType() int {
+	if a.Type == 0 {
+		return defaultA1Type
+	}
+
+	return a.Type
+}
+
+func (a *a1Config) key() string {
+	return a.ID
+}
+
+// sameDevice reports whether other addresses the same sensor.
+func (a *a1Config) sameDevice(other *a1Config) bool {
+	return a.IP.Equal(other.IP) &&
+		a.MAC == other.MAC &&
+		a.devType() == other.devType()
+}
+
+// sameAccessory reports whether other would publish the same accessory.
+func (a *a1Config) sameAccessory(other *a1Config) bool {
+	return a.Name == other.Name
+}
+
+// a1Sensor is an A1 published as a HomeKit accessory with temperature,
+// humidity, light and air quality sensors. It is polled in the background
+// in the same way as the hub's own sensors.
+type a1Sensor struct {
+	id     uint64
+	dev    *remoteDevice
+	poller *sensorPoller
+
+	mu  sync.Mutex
+	cfg a1Config
+
+	// Services of the currently published accessory.
+	temperature *service.TemperatureSensor
+	humidity    *service.HumiditySensor
+	light       *service.LightSensor
+	airQuality  *service.AirQualitySensor
+}
+
+func newA1Sensor(id uint64, cfg a1Config, log *slog.Logger) *a1Sensor {
+	dev := newRemoteDevice("sensor", cfg.ID, cfg.IP, cfg.MAC, cfg.devType(), log)
+
+	a := &a1Sensor{
+		id:  id,
+		dev: dev,
+		cfg: cfg,
+		poller: newSensorPoller(log, func() (broadlink.Environment, error) {
+			bl, err := dev.get()
+			if err != nil {
+				return broadlink.Environment{}, err
+			}
+
+			return bl.CheckEnvironment()
+		}),
+	}
+
+	a.poller.subscribe(a.updateMetrics)
+	a.poller.subscribe(a.updateChars)
+
+	go a.poller.run()
+
+	return a
+}
+
+func (a *a1Sensor) config() a1Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.cfg
+}
+
+// update replaces the config of a sensor at the same address.
+func (a *a1Sensor) update(cfg a1Config) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cfg = cfg
+}
+
+// close stops polling and drops the sensor's metrics.
+func (a *a1Sensor) close() {
+	a.poller.close()
+	a.dev.close()
+
+	id := a.config().ID
+	for _, m := range a1Metrics {
+		m.DeleteLabelValues(id)
+	}
+}
+
+func (a *a1Sensor) updateMetrics(env broadlink.Environment) {
+	id := a.config().ID
+
+	a1TemperatureMetric.WithLabelValues(id).Set(env.Temperature)
+	a1HumidityMetric.WithLabelValues(id).Set(env.Humidity)
+	a1LightMetric.WithLabelValues(id).Set(float64(env.Light))
+	a1AirQualityMetric.WithLabelValues(id).Set(float64(env.AirQuality))
+	a1NoiseMetric.WithLabelValues(id).Set(float64(env.Noise))
+}
+
+func (a *a1Sensor) updateChars(env broadlink.Environment) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.setChars(env)
+}
+
+// setChars pushes a reading to the published accessory. a.mu must be held.
+func (a *a1Sensor) setChars(env broadlink.Environment) {
+	if a.temperature == nil {
+		return
+	}
+
+	a.temperature.CurrentTemperature.SetValue(env.Temperature)
+	a.humidity.CurrentRelativeHumidity.SetValue(env.Humidity)
+
+	if lux, ok := a1Lux[env.Light]; ok {
+		a.light.CurrentAmbientLightLevel.SetValue(lux)
+	}
+
+	quality, ok := a1AirQuality[env.AirQuality]
+	if !ok {
+		quality = characteristic.AirQualityUnknown
+	}
+	a.airQuality.AirQuality.SetValue(quality)
+}
+
+// accessory builds a HomeKit accessory for the sensor from its current
+// config and last reading.
+func (a *a1Sensor) accessory() *accessory.Accessory {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	info := accessory.Info{
+		Name:         a.cfg.Name,
+		Manufacturer: "BroadLink",
+		Model:        "A1",
+		SerialNumber: a.cfg.MAC,
+		ID:           a.id,
+	}
+
+	acc := accessory.New(info, accessory.TypeSensor)
+
+	a.temperature = service.NewTemperatureSensor()
+	a.humidity = service.NewHumiditySensor()
+	a.light = service.NewLightSensor()
+	a.airQuality = service.NewAirQualitySensor()
+
+	acc.AddService(a.temperature.Service)
+	acc.AddService(a.humidity.Service)
+	acc.AddService(a.light.Service)
+	acc.AddService(a.airQuality.Service)
+
+	if env, last, _ := a.poller.reading(); !last.IsZero() {
+		a.setChars(env)
+	}
+
+	return acc
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+const apiPrefix = "/api/v1/"
+
+// api is the REST/JSON control API. It covers the hub and the fans and
+// macros driven through it, not devices hkrm4 connects to directly such as
+// plugs and A1 sensors. State changes go through the same fan methods as
+// HomeKit, so HomeKit controllers see them.
+type api struct {
+	srv        *server
+	token      string
+	setup      *setupInfo
+	configPath string
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type deviceInfo struct {
+	ID    string `json:"id"`
+	IP    string `json:"ip"`
+	MAC   string `json:"mac"`
+	Type  int    `json:"type"`
+	Model string `json:"model"`
+	IR    bool   `json:"ir"`
+	RF    bool   `json:"rf"`
+}
+
+type accessoryInfo struct {
+	ID          string   `json:"id"`
+	AccessoryID uint64   `json:"accessoryId"`
+	Name        string   `json:"name"`
+	Kind        string   `json:"kind"`
+	SpeedMode   string   `json:"speedMode"`
+	Commands    []string `json:"commands"`
+	State       fanState `json:"state"`
+}
+
+type accessoryUpdate struct {
+	On    *bool    `json:"on"`
+	Speed *float64 `json:"speed"`
+	Light *bool    `json:"light"`
+}
+
+type sendRequest struct {
+	Accessory string `json:"accessory"`
+	Command   string `json:"command"`
+	Code      code   `json:"code"`
+}
+
+type learnRequest struct {
+	Kind string `json:"kind"`
+}
+
+type learnResponse struct {
+	Code code `json:"code"`
+}
+
+type commandUpdate struct {
+	Code code `json:"code"`
+}
+
+type macroInfo struct {
+	ID          string `json:"id"`
+	AccessoryID uint64 `json:"accessoryId"`
+	Name        string `json:"name"`
+}
+
+type pairingInfo struct {
+	SetupCode    string   `json:"setupCode"`
+	SetupPayload string   `json:"setupPayload"`
+	Controllers  []string `json:"controllers"`
+}
+
+type sensorReading struct {
+	Temperature float64 `json:"temperature"`
+	Humidity    float64 `json:"humidity"`
+}
+
+// defaultDeviceID identifies the hub configured at the top level of the
+// config file.
+const defaultDeviceID = "default"
+
+func newAPI(srv *server, token string, setup *setupInfo, configPath string) *api {
+	return &api{
+		srv:        srv,
+		token:      token,
+		setup:      setup,
+		configPath: configPath,
+	}
+}
+
+// register adds the API handlers to mux.
+func (a *api) register(mux *http.ServeMux) {
+	mux.HandleFunc(apiPrefix+"openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+	})
+
+	mux.Handle(apiPrefix, a.authenticate(http.HandlerFunc(a.route)))
+}
+
+func (a *api) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hkrm4"`)
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *api) route(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "devices" && r.Method == http.MethodGet:
+		a.devices(w, r)
+	case path == "sensors" && r.Method == http.MethodGet:
+		a.sensors(w, r)
+	case path == "accessories" && r.Method == http.MethodGet:
+		a.accessories(w, r)
+	case len(parts) == 2 && parts[0] == "accessories" && r.Method == http.MethodGet:
+		a.accessory(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "accessories" && (r.Method == http.MethodPatch || r.Method == http.MethodPost):
+		a.updateAccessory(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "accessories" && parts[2] == "home" && r.Method == http.MethodPost:
+		a.homeAccessory(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "accessories" && parts[2] == "commands" && r.Method == http.MethodPut:
+		a.saveCommand(w, r, parts[1], parts[3])
+	case path == "commands" && r.Method == http.MethodGet:
+		a.commands(w, r)
+	case path == "macros" && r.Method == http.MethodGet:
+		a.macros(w, r)
+	case len(parts) == 3 && parts[0] == "macros" && parts[2] == "run" && r.Method == http.MethodPost:
+		a.runMacro(w, r, parts[1])
+	case path == "send" && r.Method == http.MethodPost:
+		a.send(w, r)
+	case path == "learn" && r.Method == http.MethodPost:
+		a.learn(w, r)
+	case path == "pairing" && r.Method == http.MethodGet:
+		a.pairing(w, r)
+	case path == "pairing/qr.png" && r.Method == http.MethodGet:
+		a.setup.qrHandler(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (a *api) devices(w http.ResponseWriter, r *http.Request) {
+	cfg := a.srv.config()
+	info := a.srv.bl.Info()
+
+	writeJSON(w, http.StatusOK, []deviceInfo{{
+		ID:    defaultDeviceID,
+		IP:    cfg.IP.String(),
+		MAC:   cfg.MAC,
+		Type:  cfg.Type,
+		Model: info.Name,
+		IR:    info.IR,
+		RF:    info.RF,
+	}})
+}
+
+func (a *api) sensors(w http.ResponseWriter, r *http.Request) {
+	temp, hum, err := a.srv.bl.CheckSensors()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sensorReading{
+		Temperature: temp,
+		Humidity:    hum,
+	})
+}
+
+func describeFan(f *fan) accessoryInfo {
+	cfg := f.config()
+
+	var cmds []string
+	for name := range f.commands() {
+		cmds = append(cmds, name)
+	}
+
+	sort.Strings(cmds)
+
+	mode := speedModeAbsolute
+	if cfg.relative() {
+		mode = speedModeRelative
+	}
+
+	return accessoryInfo{
+		ID:          cfg.ID,
+		AccessoryID: f.id,
+		Name:        cfg.Name,
+		Kind:        "fan",
+		SpeedMode:   mode,
+		Commands:    cmds,
+		State:       f.state(),
+	}
+}
+
+func (a *api) accessories(w http.ResponseWriter, r *http.Request) {
+	infos := []accessoryInfo{}
+	for _, f := range a.srv.fanList() {
+		infos = append(infos, describeFan(f))
+	}
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *api) accessory(w http.ResponseWriter, r *http.Request, id string) {
+	f := a.srv.fan(id)
+	if f == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such accessory %q", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, describeFan(f))
+}
+
+func (a *api) updateAccessory(w http.ResponseWriter, r *http.Request, id string) {
+	f := a.srv.fan(id)
+	if f == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such accessory %q", id))
+		return
+	}
+
+	var upd accessoryUpdate
+	err := json.NewDecoder(r.Body).Decode(&upd)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if upd.Speed != nil && (*upd.Speed < 0 || *upd.Speed > 100) {
+		writeError(w, http.StatusBadRequest, errors.New("speed must be between 0 and 100"))
+		return
+	}
+
+	err = f.set(upd.On, upd.Speed, upd.Light)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, describeFan(f))
+}
+
+func (a *api) homeAccessory(w http.ResponseWriter, r *http.Request, id string) {
+	f := a.srv.fan(id)
+	if f == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such accessory %q", id))
+		return
+	}
+
+	cfg := f.config()
+	if !cfg.relative() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("accessory %q does not use relative speed control", id))
+		return
+	}
+
+	err := f.home()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, describeFan(f))
+}
+
+func (a *api) send(w http.ResponseWriter, r *http.Request) {
+	var req sendRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cmd := command{Code: req.Code}
+	if req.Command != "" && req.Accessory == "" {
+		c, ok := a.srv.config().Commands[req.Command]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no such command %q", req.Command))
+			return
+		}
+
+		cmd = c
+	} else if req.Command != "" {
+		f := a.srv.fan(req.Accessory)
+		if f == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no such accessory %q", req.Accessory))
+			return
+		}
+
+		c, ok := f.commands()[req.Command]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("accessory %q has no command %q", req.Accessory, req.Command))
+			return
+		}
+
+		cmd = c
+	}
+
+	if len(cmd.Code) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("either a command or a code is required"))
+		return
+	}
+
+	err = checkCode(a.srv.bl.Info(), cmd.Code)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("code %v", err))
+		return
+	}
+
+	// Raw codes are counted under the command name "code".
+	name := req.Command
+	if name == "" {
+		name = "code"
+	}
+
+	countSend(req.Accessory, name)
+
+	err = cmd.send(a.srv.bl)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) commands(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range a.srv.config().Commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (a *api) macros(w http.ResponseWriter, r *http.Request) {
+	infos := []macroInfo{}
+	for _, m := range a.srv.macroList() {
+		cfg := m.config()
+		infos = append(infos, macroInfo{
+			ID:          cfg.ID,
+			AccessoryID: m.id,
+			Name:        cfg.Name,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *api) runMacro(w http.ResponseWriter, r *http.Request, id string) {
+	m := a.srv.macro(id)
+	if m == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such macro %q", id))
+		return
+	}
+
+	err := m.run()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *api) learn(w http.ResponseWriter, r *http.Request) {
+	var req learnRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var data []byte
+	switch req.Kind {
+	case "ir", "":
+		data, err = a.srv.bl.Learn()
+	case "rf":
+		data, err = a.srv.bl.LearnRF()
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown code kind %q, expected ir or rf", req.Kind))
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, learnResponse{Code: data})
+}
+
+func (a *api) saveCommand(w http.ResponseWriter, r *http.Request, id, name string) {
+	if a.srv.fan(id) == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such accessory %q", id))
+		return
+	}
+
+	var upd commandUpdate
+	err := json.NewDecoder(r.Body).Decode(&upd)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(upd.Code) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("a code is required"))
+		return
+	}
+
+	err = saveFanCommand(a.configPath, id, name, upd.Code)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) pairing(w http.ResponseWriter, r *http.Request) {
+	uri, err := a.setup.uri()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	controllers, err := pairedControllers(a.srv.config().Data)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pairingInfo{
+		SetupCode:    a.setup.formattedPin(),
+		SetupPayload: uri,
+		Controllers:  controllers,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
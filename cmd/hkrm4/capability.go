@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+)
+
+// Kinds of code, told apart by the first byte of the packet.
+const (
+	codeIR      = "IR"
+	codeRF      = "RF"
+	codeUnknown = ""
+)
+
+func codeKind(c code) string {
+	if len(c) == 0 {
+		return codeUnknown
+	}
+
+	switch c[0] {
+	case 0x26:
+		return codeIR
+	case 0xb2, 0xd7:
+		return codeRF
+	default:
+		return codeUnknown
+	}
+}
+
+// checkCapabilities refuses a config with commands the hub cannot send,
+// such as RF codes for an IR-only RM Mini 3. Codes in no format hkrm4
+// recognises are only warned about.
+func checkCapabilities(info broadlink.DeviceInfo, cfg *config) error {
+	cmds := make(map[string]command)
+	for _, f := range cfg.Fans {
+		for name, c := range f.commands() {
+			cmds[fmt.Sprintf("fan %q %s", f.ID, name)] = c
+		}
+	}
+
+	for name, c := range cfg.Commands {
+		cmds[fmt.Sprintf("command %q", name)] = c
+	}
+
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c := cmds[name]
+		if len(c.Code) == 0 {
+			continue
+		}
+
+		if codeKind(c.Code) == codeUnknown {
+			slog.Warn("not a recognised IR or RF code", "command", name)
+			continue
+		}
+
+		err := checkCode(info, c.Code)
+		if err != nil {
+			return fmt.Errorf("%s %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkModels refuses plugs, strips and sensors whose type is not a supported model
+// of that kind in r, rather than driving them with another model's
+// protocol.
+func checkModels(r *broadlink.Registry, cfg *config) error {
+	for _, p := range cfg.Plugs {
+		m, ok := r.Lookup(p.devType())
+		if !ok || !m.Supported {
+			return fmt.Errorf("plug %q has unsupported device type 0x%04x", p.ID, p.devType())
+		}
+
+		if !m.Power || m.Sockets > 0 {
+			return fmt.Errorf("plug %q has device type 0x%04x, which is the %s rather than a smart plug", p.ID, p.devType(), m.Name)
+		}
+	}
+
+	for _, s := range cfg.Strips {
+		m, ok := r.Lookup(s.devType())
+		if !ok || !m.Supported {
+			return fmt.Errorf("strip %q has unsupported device type 0x%04x", s.ID, s.devType())
+		}
+
+		if !m.Power || m.Sockets == 0 {
+			return fmt.Errorf("strip %q has device type 0x%04x, which is the %s rather than a power strip", s.ID, s.devType(), m.Name)
+		}
+	}
+
+	for _, a := range cfg.Sensors {
+		m, ok := r.Lookup(a.devType())
+		if !ok || !m.Supported {
+			return fmt.Errorf("sensor %q has unsupported device type 0x%04x", a.ID, a.devType())
+		}
+
+		if !m.Environment {
+			return fmt.Errorf("sensor %q has device type 0x%04x, which is the %s rather than an A1", a.ID, a.devType(), m.Name)
+		}
+	}
+
+	return nil
+}
+
+// checkCode returns an error if the hub cannot send c. Codes in no format
+// hkrm4 recognises are given the benefit of the doubt.
+func checkCode(info broadlink.DeviceInfo, c code) error {
+	switch codeKind(c) {
+	case codeIR:
+		if !info.IR {
+			return fmt.Errorf("is an IR code, which the %s cannot send", info.Name)
+		}
+	case codeRF:
+		if !info.RF {
+			return fmt.Errorf("is an RF code, which the %s cannot send", info.Name)
+		}
+	}
+
+	return nil
+}
+
+// requirePower refuses a device which is not a smart plug or power strip.
+func requirePower(info broadlink.DeviceInfo) error {
+	if !info.Power {
+		return fmt.Errorf("the %s cannot switch power", info.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	"gopkg.in/yaml.v3"
+)
+
+// command is a code with options for how it is sent. In config files it is
+// either just the code, or a table with the code, a repeat count and a gap
+// in milliseconds:
+//
+//	speed: ["2600...", {code: "2600...", repeat: 2, gapMs: 300}]
+//
+// Repeat is the repeat byte of the Broadlink packet, so the hub transmits the
+// code repeat+1 times. GapMs holds off the next transmission on the hub.
+type command struct {
+	Code   code `json:"code" yaml:"code" toml:"code"`
+	Repeat int  `json:"repeat,omitempty" yaml:"repeat,omitempty" toml:"repeat,omitempty"`
+	GapMs  int  `json:"gapMs,omitempty" yaml:"gapMs,omitempty" toml:"gapMs,omitempty"`
+}
+
+// commandTable has the fields of command without its methods, for decoding
+// the table form.
+type commandTable command
+
+func (c command) plain() bool {
+	return c.Repeat == 0 && c.GapMs == 0
+}
+
+func (c *command) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		return json.Unmarshal(data, &c.Code)
+	}
+
+	return json.Unmarshal(data, (*commandTable)(c))
+}
+
+func (c command) MarshalJSON() ([]byte, error) {
+	if c.plain() {
+		return json.Marshal(c.Code)
+	}
+
+	return json.Marshal(commandTable(c))
+}
+
+func (c *command) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&c.Code)
+	}
+
+	return n.Decode((*commandTable)(c))
+}
+
+func (c command) MarshalYAML() (interface{}, error) {
+	if c.plain() {
+		return c.Code, nil
+	}
+
+	return commandTable(c), nil
+}
+
+func (c *command) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		return c.Code.UnmarshalText([]byte(v))
+	case map[string]interface{}:
+		for key, field := range v {
+			var ok bool
+			switch key {
+			case "code":
+				var s string
+				s, ok = field.(string)
+				if ok {
+					err := c.Code.UnmarshalText([]byte(s))
+					if err != nil {
+						return err
+					}
+				}
+			case "repeat":
+				var n int64
+				n, ok = field.(int64)
+				c.Repeat = int(n)
+			case "gapMs":
+				var n int64
+				n, ok = field.(int64)
+				c.GapMs = int(n)
+			default:
+				return fmt.Errorf("unknown command field %q", key)
+			}
+
+			if !ok {
+				return fmt.Errorf("invalid command field %q: %v", key, field)
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("invalid command %v", v)
+	}
+}
+
+// MarshalTOML writes the table form as an inline table, so that commands
+// can be array elements.
+func (c command) MarshalTOML() ([]byte, error) {
+	hex, err := c.Code.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.plain() {
+		return []byte(strconv.Quote(string(hex))), nil
+	}
+
+	fields := []string{"code = " + strconv.Quote(string(hex))}
+	if c.Repeat != 0 {
+		fields = append(fields, "repeat = "+strconv.Itoa(c.Repeat))
+	}
+
+	if c.GapMs != 0 {
+		fields = append(fields, "gapMs = "+strconv.Itoa(c.GapMs))
+	}
+
+	return []byte("{ " + strings.Join(fields, ", ") + " }"), nil
+}
+
+func (c command) validate() error {
+	if len(c.Code) == 0 {
+		return fmt.Errorf("no code")
+	}
+
+	if c.Repeat < 0 || c.Repeat > 0xff {
+		return fmt.Errorf("repeat %d is out of range 0-255", c.Repeat)
+	}
+
+	if c.GapMs < 0 {
+		return fmt.Errorf("negative gapMs %d", c.GapMs)
+	}
+
+	return nil
+}
+
+// send transmits the command through bl.
+func (c command) send(bl hub) error {
+	data := []byte(c.Code)
+	if c.Repeat > 0 {
+		var err error
+		data, err = broadlink.WithRepeat(data, c.Repeat)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bl.SendDataGap(data, time.Duration(c.GapMs)*time.Millisecond)
+}
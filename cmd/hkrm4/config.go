@@ -0,0 +1,622 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/brutella/hc"
+	"gopkg.in/yaml.v3"
+)
+
+// code is an IR or RF code. In config files it is written as base64, or as
+// hex with a "hex:" prefix; a "base64:" prefix is also accepted. Hex is
+// never guessed, since many base64 codes are made only of hex digits.
+type code []byte
+
+func (c *code) UnmarshalText(text []byte) error {
+	s := string(text)
+
+	var b []byte
+	var err error
+	switch {
+	case strings.HasPrefix(s, "hex:"):
+		b, err = hex.DecodeString(strings.TrimPrefix(s, "hex:"))
+	case strings.HasPrefix(s, "base64:"):
+		b, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "base64:"))
+	default:
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid code %q: %v", s, err)
+	}
+
+	*c = b
+	return nil
+}
+
+func (c code) MarshalText() ([]byte, error) {
+	return []byte("hex:" + hex.EncodeToString(c)), nil
+}
+
+type fanConfig struct {
+	ID               string `json:"id" yaml:"id" toml:"id"`
+	Name             string `json:"name" yaml:"name" toml:"name"`
+	Manufacturer     string `json:"manufacturer,omitempty" yaml:"manufacturer,omitempty" toml:"manufacturer,omitempty"`
+	Model            string `json:"model,omitempty" yaml:"model,omitempty" toml:"model,omitempty"`
+	FirmwareRevision string `json:"firmwareRevision,omitempty" yaml:"firmwareRevision,omitempty" toml:"firmwareRevision,omitempty"`
+	SerialNumber     string `json:"serialNumber,omitempty" yaml:"serialNumber,omitempty" toml:"serialNumber,omitempty"`
+
+	// DebounceMs is how long HomeKit power and speed changes must settle
+	// before a code is sent, so that dragging the slider sends only the
+	// final speed. It defaults to 500.
+	DebounceMs int `json:"debounceMs,omitempty" yaml:"debounceMs,omitempty" toml:"debounceMs,omitempty"`
+
+	// SpeedMode is "absolute" for fans with a code per speed, or
+	// "relative" for fans with only speedUp and speedDown codes and
+	// optionally a power toggle. By default it follows the codes given.
+	SpeedMode string `json:"speedMode,omitempty" yaml:"speedMode,omitempty" toml:"speedMode,omitempty"`
+
+	// Levels is the number of speeds of a relative fan.
+	Levels int `json:"levels,omitempty" yaml:"levels,omitempty" toml:"levels,omitempty"`
+
+	Commands struct {
+		LightToggle command   `json:"lightToggle" yaml:"lightToggle" toml:"lightToggle"`
+		Speed       []command `json:"speed,omitempty" yaml:"speed,omitempty" toml:"speed,omitempty"`
+		SpeedUp     *command  `json:"speedUp,omitempty" yaml:"speedUp,omitempty" toml:"speedUp,omitempty"`
+		SpeedDown   *command  `json:"speedDown,omitempty" yaml:"speedDown,omitempty" toml:"speedDown,omitempty"`
+		Power       *command  `json:"power,omitempty" yaml:"power,omitempty" toml:"power,omitempty"`
+	} `json:"commands" yaml:"commands" toml:"commands"`
+}
+
+const (
+	speedModeAbsolute = "absolute"
+	speedModeRelative = "relative"
+)
+
+// commands returns the fan's commands by name.
+func (f *fanConfig) commands() map[string]command {
+	cmds := map[string]command{
+		"lightToggle": f.Commands.LightToggle,
+	}
+
+	for i, c := range f.Commands.Speed {
+		cmds[fmt.Sprintf("speed%d", i)] = c
+	}
+
+	if f.Commands.SpeedUp != nil {
+		cmds["speedUp"] = *f.Commands.SpeedUp
+	}
+
+	if f.Commands.SpeedDown != nil {
+		cmds["speedDown"] = *f.Commands.SpeedDown
+	}
+
+	if f.Commands.Power != nil {
+		cmds["power"] = *f.Commands.Power
+	}
+
+	return cmds
+}
+
+// relative reports whether the fan's speed is set by pressing speedUp and
+// speedDown.
+func (f *fanConfig) relative() bool {
+	return f.SpeedMode == speedModeRelative || (f.SpeedMode == "" && len(f.Commands.Speed) == 0)
+}
+
+// levels returns the number of speeds of the fan, not counting off.
+func (f *fanConfig) levels() int {
+	if f.relative() {
+		return f.Levels
+	}
+
+	return len(f.Commands.Speed) - 1
+}
+
+type config struct {
+	IP   net.IP `json:"ip,omitempty" yaml:"ip,omitempty" toml:"ip,omitempty"`
+	MAC  string `json:"mac,omitempty" yaml:"mac,omitempty" toml:"mac,omitempty"`
+	Type int    `json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"`
+
+	// MinIntervalMs is the minimum time between transmissions on the hub.
+	MinIntervalMs int `json:"minIntervalMs,omitempty" yaml:"minIntervalMs,omitempty" toml:"minIntervalMs,omitempty"`
+
+	// DeviceModels and the models in DeviceModelsFile add to or replace the
+	// built-in device models.
+	DeviceModels     []modelConfig `json:"deviceModels,omitempty" yaml:"deviceModels,omitempty" toml:"deviceModels,omitempty"`
+	DeviceModelsFile string        `json:"deviceModelsFile,omitempty" yaml:"deviceModelsFile,omitempty" toml:"deviceModelsFile,omitempty"`
+
+	// ReadyMaxAgeSeconds is how recently the hub's sensors must have been
+	// read for /readyz to report ready.
+	ReadyMaxAgeSeconds int `json:"readyMaxAgeSeconds,omitempty" yaml:"readyMaxAgeSeconds,omitempty" toml:"readyMaxAgeSeconds,omitempty"`
+
+	// LocalAddr is the local address and port hkrm4 talks to devices from.
+	LocalAddr string `json:"localAddr,omitempty" yaml:"localAddr,omitempty" toml:"localAddr,omitempty"`
+
+	Pin     string `json:"pin,omitempty" yaml:"pin,omitempty" toml:"pin,omitempty"`
+	PinFile string `json:"pinFile,omitempty" yaml:"pinFile,omitempty" toml:"pinFile,omitempty"`
+	Port    string `json:"port,omitempty" yaml:"port,omitempty" toml:"port,omitempty"`
+	Data    string `json:"data,omitempty" yaml:"data,omitempty" toml:"data,omitempty"`
+	Metrics string `json:"metrics,omitempty" yaml:"metrics,omitempty" toml:"metrics,omitempty"`
+	Verbose bool   `json:"verbose,omitempty" yaml:"verbose,omitempty" toml:"verbose,omitempty"`
+
+	// LogLevel is trace, debug, info, warn or error, and LogFormat text or
+	// json.
+	LogLevel  string `json:"logLevel,omitempty" yaml:"logLevel,omitempty" toml:"logLevel,omitempty"`
+	LogFormat string `json:"logFormat,omitempty" yaml:"logFormat,omitempty" toml:"logFormat,omitempty"`
+
+	API          string `json:"api,omitempty" yaml:"api,omitempty" toml:"api,omitempty"`
+	APIToken     string `json:"apiToken,omitempty" yaml:"apiToken,omitempty" toml:"apiToken,omitempty"`
+	APITokenFile string `json:"apiTokenFile,omitempty" yaml:"apiTokenFile,omitempty" toml:"apiTokenFile,omitempty"`
+
+	MQTT                string `json:"mqtt,omitempty" yaml:"mqtt,omitempty" toml:"mqtt,omitempty"`
+	MQTTUsername        string `json:"mqttUsername,omitempty" yaml:"mqttUsername,omitempty" toml:"mqttUsername,omitempty"`
+	MQTTPassword        string `json:"mqttPassword,omitempty" yaml:"mqttPassword,omitempty" toml:"mqttPassword,omitempty"`
+	MQTTPasswordFile    string `json:"mqttPasswordFile,omitempty" yaml:"mqttPasswordFile,omitempty" toml:"mqttPasswordFile,omitempty"`
+	MQTTPrefix          string `json:"mqttPrefix,omitempty" yaml:"mqttPrefix,omitempty" toml:"mqttPrefix,omitempty"`
+	MQTTDiscoveryPrefix string `json:"mqttDiscoveryPrefix,omitempty" yaml:"mqttDiscoveryPrefix,omitempty" toml:"mqttDiscoveryPrefix,omitempty"`
+
+	Fans    []fanConfig   `json:"fans" yaml:"fans" toml:"fans"`
+	Plugs   []plugConfig  `json:"plugs,omitempty" yaml:"plugs,omitempty" toml:"plugs,omitempty"`
+	Strips  []stripConfig `json:"strips,omitempty" yaml:"strips,omitempty" toml:"strips,omitempty"`
+	Sensors []a1Config    `json:"sensors,omitempty" yaml:"sensors,omitempty" toml:"sensors,omitempty"`
+
+	Thermostats []thermostatConfig `json:"thermostats,omitempty" yaml:"thermostats,omitempty" toml:"thermostats,omitempty"`
+	Curtains    []curtainConfig    `json:"curtains,omitempty" yaml:"curtains,omitempty" toml:"curtains,omitempty"`
+
+	Commands map[string]command `json:"commands,omitempty" yaml:"commands,omitempty" toml:"commands,omitempty"`
+	Macros   []macroConfig      `json:"macros,omitempty" yaml:"macros,omitempty" toml:"macros,omitempty"`
+}
+
+const defaultData = "data"
+
+type configFormat int
+
+const (
+	formatJSON configFormat = iota
+	formatYAML
+	formatTOML
+)
+
+// configFormatOf picks the config format from the file extension, falling
+// back to JSON.
+func configFormatOf(path string) configFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	default:
+		return formatJSON
+	}
+}
+
+func decodeConfig(r io.Reader, format configFormat, cfg *config) error {
+	switch format {
+	case formatYAML:
+		return yaml.NewDecoder(r).Decode(cfg)
+	case formatTOML:
+		_, err := toml.NewDecoder(r).Decode(cfg)
+		return err
+	default:
+		return json.NewDecoder(r).Decode(cfg)
+	}
+}
+
+func encodeConfig(w io.Writer, format configFormat, cfg *config) error {
+	switch format {
+	case formatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		err := enc.Encode(cfg)
+		if err != nil {
+			return err
+		}
+		return enc.Close()
+	case formatTOML:
+		return toml.NewEncoder(w).Encode(cfg)
+	default:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cfg)
+	}
+}
+
+// readConfig reads the config file at path as written.
+func readConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var cfg config
+	err = decodeConfig(f, configFormatOf(path), &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// loadConfig reads the config file at path, applies the overrides and
+// defaults and validates the result.
+func loadConfig(path string, o overrides) (*config, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = o.apply(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.resolveSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Data == "" {
+		cfg.Data = defaultData
+	}
+
+	if cfg.MQTTPrefix == "" {
+		cfg.MQTTPrefix = defaultMQTTPrefix
+	}
+
+	if cfg.MQTTDiscoveryPrefix == "" {
+		cfg.MQTTDiscoveryPrefix = defaultMQTTDiscoveryPrefix
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (c *config) validate() error {
+	if c.IP == nil {
+		return fmt.Errorf("missing device ip")
+	}
+
+	if c.MAC == "" {
+		return fmt.Errorf("missing device mac")
+	}
+
+	_, err := net.ParseMAC(c.MAC)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseLogLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	switch c.LogFormat {
+	case "", logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", c.LogFormat)
+	}
+
+	if c.Pin != "" {
+		_, err = hc.ValidatePin(c.Pin)
+		if err != nil {
+			return fmt.Errorf("invalid pin: %v", err)
+		}
+	}
+
+	types := make(map[int]bool)
+	for i, m := range c.DeviceModels {
+		err := m.validate()
+		if err != nil {
+			return fmt.Errorf("device model %d %v", i, err)
+		}
+
+		if types[m.Type] {
+			return fmt.Errorf("duplicate device model type 0x%04x", m.Type)
+		}
+
+		types[m.Type] = true
+	}
+
+	if c.MinIntervalMs < 0 {
+		return fmt.Errorf("negative minIntervalMs %d", c.MinIntervalMs)
+	}
+
+	if c.ReadyMaxAgeSeconds < 0 {
+		return fmt.Errorf("negative readyMaxAgeSeconds %d", c.ReadyMaxAgeSeconds)
+	}
+
+	if c.API != "" && c.APIToken == "" {
+		return fmt.Errorf("the control api requires an api token")
+	}
+
+	if c.APIToken != "" && c.apiPort() == "" {
+		return fmt.Errorf("the control api requires an api or metrics port")
+	}
+
+	ids := make(map[string]bool)
+	for i, f := range c.Fans {
+		if f.ID == "" {
+			return fmt.Errorf("fan %d has no id", i)
+		}
+
+		if ids[f.ID] {
+			return fmt.Errorf("duplicate fan id %q", f.ID)
+		}
+
+		ids[f.ID] = true
+
+		if f.Name == "" {
+			return fmt.Errorf("fan %q has no name", f.ID)
+		}
+
+		err := f.validateSpeeds()
+		if err != nil {
+			return fmt.Errorf("fan %q %v", f.ID, err)
+		}
+
+		err = f.Commands.LightToggle.validate()
+		if err != nil {
+			return fmt.Errorf("fan %q light toggle command: %v", f.ID, err)
+		}
+
+		if f.DebounceMs < 0 {
+			return fmt.Errorf("fan %q has a negative debounceMs", f.ID)
+		}
+	}
+
+	ids = make(map[string]bool)
+	for i, p := range c.Plugs {
+		if p.ID == "" {
+			return fmt.Errorf("plug %d has no id", i)
+		}
+
+		if ids[p.ID] {
+			return fmt.Errorf("duplicate plug id %q", p.ID)
+		}
+
+		ids[p.ID] = true
+
+		err := p.validate()
+		if err != nil {
+			return fmt.Errorf("plug %q %v", p.ID, err)
+		}
+	}
+
+	ids = make(map[string]bool)
+	for i, s := range c.Strips {
+		if s.ID == "" {
+			return fmt.Errorf("strip %d has no id", i)
+		}
+
+		if ids[s.ID] {
+			return fmt.Errorf("duplicate strip id %q", s.ID)
+		}
+
+		ids[s.ID] = true
+
+		err := s.validate()
+		if err != nil {
+			return fmt.Errorf("strip %q %v", s.ID, err)
+		}
+	}
+
+	ids = make(map[string]bool)
+	for i, a := range c.Sensors {
+		if a.ID == "" {
+			return fmt.Errorf("sensor %d has no id", i)
+		}
+
+		if ids[a.ID] {
+			return fmt.Errorf("duplicate sensor id %q", a.ID)
+		}
+
+		ids[a.ID] = true
+
+		err := a.validate()
+		if err != nil {
+			return fmt.Errorf("sensor %q %v", a.ID, err)
+		}
+	}
+
+	ids = make(map[string]bool)
+	for i, t := range c.Thermostats {
+		if t.ID == "" {
+			return fmt.Errorf("thermostat %d has no id", i)
+		}
+
+		if ids[t.ID] {
+			return fmt.Errorf("duplicate thermostat id %q", t.ID)
+		}
+
+		ids[t.ID] = true
+
+		err := t.validate()
+		if err != nil {
+			return fmt.Errorf("thermostat %q %v", t.ID, err)
+		}
+	}
+
+	ids = make(map[string]bool)
+	for i, cc := range c.Curtains {
+		if cc.ID == "" {
+			return fmt.Errorf("curtain %d has no id", i)
+		}
+
+		if ids[cc.ID] {
+			return fmt.Errorf("duplicate curtain id %q", cc.ID)
+		}
+
+		ids[cc.ID] = true
+
+		err := cc.validate()
+		if err != nil {
+			return fmt.Errorf("curtain %q %v", cc.ID, err)
+		}
+	}
+
+	for name, cmd := range c.Commands {
+		err := cmd.validate()
+		if err != nil {
+			return fmt.Errorf("command %q: %v", name, err)
+		}
+	}
+
+	ids = make(map[string]bool)
+	for i, m := range c.Macros {
+		if m.ID == "" {
+			return fmt.Errorf("macro %d has no id", i)
+		}
+
+		if ids[m.ID] {
+			return fmt.Errorf("duplicate macro id %q", m.ID)
+		}
+
+		ids[m.ID] = true
+
+		if m.Name == "" {
+			return fmt.Errorf("macro %q has no name", m.ID)
+		}
+
+		for j, step := range m.Steps {
+			err := step.validate(c)
+			if err != nil {
+				return fmt.Errorf("macro %q step %d: %v", m.ID, j, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateSpeeds checks that the fan has either a code per speed, or speedUp
+// and speedDown codes with a number of levels.
+func (f *fanConfig) validateSpeeds() error {
+	switch f.SpeedMode {
+	case "", speedModeAbsolute, speedModeRelative:
+	default:
+		return fmt.Errorf("has unknown speedMode %q, expected absolute or relative", f.SpeedMode)
+	}
+
+	if f.relative() {
+		if len(f.Commands.Speed) > 0 {
+			return fmt.Errorf("has speed commands, which are not used with speedMode relative")
+		}
+
+		if f.Commands.SpeedUp == nil || f.Commands.SpeedDown == nil {
+			return fmt.Errorf("needs both speedUp and speedDown commands")
+		}
+
+		if f.Levels < 1 {
+			return fmt.Errorf("needs levels with speedUp and speedDown commands")
+		}
+
+		err := f.Commands.SpeedUp.validate()
+		if err != nil {
+			return fmt.Errorf("speedUp command: %v", err)
+		}
+
+		err = f.Commands.SpeedDown.validate()
+		if err != nil {
+			return fmt.Errorf("speedDown command: %v", err)
+		}
+
+		if f.Commands.Power != nil {
+			err = f.Commands.Power.validate()
+			if err != nil {
+				return fmt.Errorf("power command: %v", err)
+			}
+		}
+
+		return nil
+	}
+
+	if f.Commands.SpeedUp != nil || f.Commands.SpeedDown != nil || f.Commands.Power != nil {
+		return fmt.Errorf("has speedUp, speedDown or power commands, which are only used with speedMode relative")
+	}
+
+	// The first speed command turns the fan off, so at least one more is
+	// needed for the fan to do anything.
+	if len(f.Commands.Speed) < 2 {
+		return fmt.Errorf("needs at least two speed commands, or speedUp, speedDown and levels")
+	}
+
+	for j, cmd := range f.Commands.Speed {
+		err := cmd.validate()
+		if err != nil {
+			return fmt.Errorf("speed command %d: %v", j, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *config) hasFan(id string) bool {
+	for _, f := range c.Fans {
+		if f.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiPort returns the port the control API is served on.
+func (c *config) apiPort() string {
+	if c.API != "" {
+		return c.API
+	}
+
+	return c.Metrics
+}
+
+// needsRestart reports whether moving from c to other changes settings which
+// are only read at startup.
+func (c *config) needsRestart(other *config) bool {
+	return !c.IP.Equal(other.IP) ||
+		c.MAC != other.MAC ||
+		c.Type != other.Type ||
+		c.Pin != other.Pin ||
+		c.Port != other.Port ||
+		c.Data != other.Data ||
+		c.Metrics != other.Metrics ||
+		c.API != other.API ||
+		c.APIToken != other.APIToken ||
+		c.MQTT != other.MQTT ||
+		c.MQTTUsername != other.MQTTUsername ||
+		c.MQTTPassword != other.MQTTPassword ||
+		c.MQTTPrefix != other.MQTTPrefix ||
+		c.MQTTDiscoveryPrefix != other.MQTTDiscoveryPrefix ||
+		c.DeviceModelsFile != other.DeviceModelsFile ||
+		c.LocalAddr != other.LocalAddr ||
+		c.ReadyMaxAgeSeconds != other.ReadyMaxAgeSeconds ||
+		c.LogFormat != other.LogFormat ||
+		!reflect.DeepEqual(c.DeviceModels, other.DeviceModels)
+}
+
+// sameAccessory reports whether the HomeKit accessory built from f would be
+// identical to the one built from other. Only the IR codes may differ.
+func (f *fanConfig) sameAccessory(other *fanConfig) bool {
+	return f.Name == other.Name &&
+		f.Manufacturer == other.Manufacturer &&
+		f.Model == other.Model &&
+		f.FirmwareRevision == other.FirmwareRevision &&
+		f.SerialNumber == other.SerialNumber &&
+		f.levels() == other.levels()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseCommandName splits a fan command name as returned by fan.commands
+// into the field and, for speeds, the index.
+func parseCommandName(name string) (string, int, error) {
+	switch name {
+	case "lightToggle", "speedUp", "speedDown", "power":
+		return name, 0, nil
+	}
+
+	if strings.HasPrefix(name, "speed") {
+		i, err := strconv.Atoi(strings.TrimPrefix(name, "speed"))
+		if err == nil && i >= 0 {
+			return "speed", i, nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("unknown command %q", name)
+}
+
+func setFanCommand(fc *fanConfig, name string, c code) error {
+	field, i, err := parseCommandName(name)
+	if err != nil {
+		return err
+	}
+
+	switch field {
+	case "lightToggle":
+		fc.Commands.LightToggle.Code = c
+	case "speedUp", "speedDown", "power":
+		cmd := fc.Commands.SpeedUp
+		switch field {
+		case "speedDown":
+			cmd = fc.Commands.SpeedDown
+		case "power":
+			cmd = fc.Commands.Power
+		}
+
+		if cmd == nil {
+			return fmt.Errorf("fan %q has no command %q", fc.ID, name)
+		}
+
+		cmd.Code = c
+	case "speed":
+		if i >= len(fc.Commands.Speed) {
+			return fmt.Errorf("fan %q has no command %q", fc.ID, name)
+		}
+
+		fc.Commands.Speed[i].Code = c
+	}
+
+	return nil
+}
+
+// saveFanCommand stores a code for one of a fan's commands in the config
+// file at path. YAML files are edited in place so that comments are kept;
+// other formats are rewritten from the decoded config. The config watcher
+// then picks up the change.
+func saveFanCommand(path, fanID, name string, c code) error {
+	var buf bytes.Buffer
+
+	if configFormatOf(path) == formatYAML {
+		err := editYAMLFanCommand(path, fanID, name, c, &buf)
+		if err != nil {
+			return err
+		}
+	} else {
+		cfg, err := readConfig(path)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for i := range cfg.Fans {
+			if cfg.Fans[i].ID == fanID {
+				err = setFanCommand(&cfg.Fans[i], name, c)
+				if err != nil {
+					return err
+				}
+
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("no such fan %q", fanID)
+		}
+
+		err = encodeConfig(&buf, configFormatOf(path), cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+func editYAMLFanCommand(path, fanID, name string, c code, buf *bytes.Buffer) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return fmt.Errorf("error decoding %s: %v", path, err)
+	}
+
+	field, i, err := parseCommandName(name)
+	if err != nil {
+		return err
+	}
+
+	var fan *yaml.Node
+	if len(doc.Content) > 0 {
+		for _, n := range yamlSeq(yamlKey(doc.Content[0], "fans")) {
+			if id := yamlKey(n, "id"); id != nil && id.Value == fanID {
+				fan = n
+			}
+		}
+	}
+
+	if fan == nil {
+		return fmt.Errorf("no such fan %q", fanID)
+	}
+
+	target := yamlKey(yamlKey(fan, "commands"), field)
+	if field == "speed" {
+		speeds := yamlSeq(target)
+		if i >= len(speeds) {
+			return fmt.Errorf("fan %q has no command %q", fanID, name)
+		}
+
+		target = speeds[i]
+	}
+
+	// Commands with options are tables holding the code.
+	if target != nil && target.Kind == yaml.MappingNode {
+		target = yamlKey(target, "code")
+	}
+
+	if target == nil || target.Kind != yaml.ScalarNode {
+		return fmt.Errorf("fan %q has no command %q", fanID, name)
+	}
+
+	text, err := c.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	target.Tag = "!!str"
+	target.Style = yaml.DoubleQuotedStyle
+	target.Value = string(text)
+
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	err = enc.Encode(&doc)
+	if err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// yamlKey returns the value for key in a mapping node, or nil.
+func yamlKey(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// yamlSeq returns the items of a sequence node.
+func yamlSeq(n *yaml.Node) []*yaml.Node {
+	if n == nil || n.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	return n.Content
+}
+
+// writeFileAtomic replaces the file at path with data, keeping its mode.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
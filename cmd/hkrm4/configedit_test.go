@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brutella/hc"
+)
+
+const testEditYAMLConfig = `
+ip: 127.0.0.1
+mac: aa:bb:cc:dd:ee:ff
+data: %DATA%
+fans:
+  - id: bed
+    name: Bedroom Fan
+    commands:
+      # The light is learned later.
+      lightToggle: hex:260001ff
+      speed: [hex:26000100, hex:26000101, hex:26000102]
+`
+
+const testEditJSONConfig = `{
+  "ip": "127.0.0.1",
+  "mac": "aa:bb:cc:dd:ee:ff",
+  "data": "%DATA%",
+  "fans": [{
+    "id": "bed",
+    "name": "Bedroom Fan",
+    "commands": {
+      "lightToggle": "hex:260001ff",
+      "speed": ["hex:26000100", "hex:26000101", "hex:26000102"]
+    }
+  }]
+}`
+
+// TestLearnAndSaveCommand learns a code through the API, saves it to the
+// config file and checks it reads back unchanged.
+func TestLearnAndSaveCommand(t *testing.T) {
+	learned := []byte{0x26, 0x00, 0x12, 0x34}
+
+	tests := []struct {
+		file    string
+		config  string
+		command string
+		code    func(*config) code
+	}{
+		{"config.yaml", testEditYAMLConfig, "lightToggle", func(c *config) code { return c.Fans[0].Commands.LightToggle.Code }},
+		{"config.yaml", testEditYAMLConfig, "speed1", func(c *config) code { return c.Fans[0].Commands.Speed[1].Code }},
+		{"config.json", testEditJSONConfig, "lightToggle", func(c *config) code { return c.Fans[0].Commands.LightToggle.Code }},
+		{"config.json", testEditJSONConfig, "speed1", func(c *config) code { return c.Fans[0].Commands.Speed[1].Code }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file+"/"+tt.command, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tt.file)
+			err := os.WriteFile(path, []byte(strings.ReplaceAll(tt.config, "%DATA%", dir)), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := loadConfig(path, overrides{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			log := slog.New(slog.NewTextHandler(io.Discard, nil))
+			srv, err := newServer(&fakeHub{learned: learned}, hc.Config{StoragePath: dir}, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = srv.apply(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mux := http.NewServeMux()
+			newAPI(srv, "token", nil, path).register(mux)
+
+			call := func(method, target, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, target, strings.NewReader(body))
+				req.Header.Set("Authorization", "Bearer token")
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, req)
+				return rec
+			}
+
+			rec := call(http.MethodPost, apiPrefix+"learn", `{"kind":"ir"}`)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("learning returned %d: %s", rec.Code, rec.Body)
+			}
+
+			var resp learnResponse
+			err = json.Unmarshal(rec.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := json.Marshal(commandUpdate{Code: resp.Code})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec = call(http.MethodPut, apiPrefix+"accessories/bed/commands/"+tt.command, string(body))
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("saving returned %d: %s", rec.Code, rec.Body)
+			}
+
+			saved, err := loadConfig(path, overrides{})
+			if err != nil {
+				t.Fatalf("error reloading the saved config: %v", err)
+			}
+
+			if got := tt.code(saved); !bytes.Equal(got, learned) {
+				t.Errorf("%s reads back as %x, want %x", tt.command, got, learned)
+			}
+
+			// The other commands are left alone.
+			if got := saved.Fans[0].Commands.Speed[0].Code; !bytes.Equal(got, []byte{0x26, 0x00, 0x01, 0x00}) {
+				t.Errorf("speed0 reads back as %x", got)
+			}
+
+			if strings.HasSuffix(tt.file, ".yaml") {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Contains(b, []byte("# The light is learned later.")) {
+					t.Errorf("comment was dropped from the saved config:\n%s", b)
+				}
+			}
+		})
+	}
+}
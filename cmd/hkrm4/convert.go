@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// runConfigCommand implements the "hkrm4 config" subcommands.
+func runConfigCommand(args []string) {
+	if len(args) == 0 || args[0] != "convert" {
+		fmt.Fprintln(os.Stderr, "usage: hkrm4 config convert <input> <output>")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("config convert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hkrm4 config convert <input> <output>")
+		fmt.Fprintln(fs.Output(), "\nThe formats are chosen by file extension: .json, .yaml, .yml or .toml.")
+	}
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err := convertConfig(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func convertConfig(in, out string) error {
+	cfg, err := readConfig(in)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = encodeConfig(f, configFormatOf(out), cfg)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error encoding %s: %v", out, err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultDooyaType = 0x4e4d
+
+const (
+	// curtainMoveInterval is how often a moving curtain is polled to see
+	// whether it has reached its target.
+	curtainMoveInterval = time.Second
+
+	// curtainMoveTimeout bounds a move, in case the motor stalls short of
+	// its target.
+	curtainMoveTimeout = 2 * time.Minute
+)
+
+var curtainPositionMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "hkrm4",
+	Subsystem: "curtain",
+	Name:      "position_percentage",
+	Help:      "How far open a curtain is, in percent.",
+}, []string{"id"})
+
+// curtainConfig is a Dooya curtain motor.
+type curtainConfig struct {
+	ID   string `json:"id" yaml:"id" toml:"id"`
+	Name string `json:"name" yaml:"name" toml:"name"`
+
+	IP   net.IP `json:"ip" yaml:"ip" toml:"ip"`
+	MAC  string `json:"mac" yaml:"mac" toml:"mac"`
+	Type int    `json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"`
+}
+
+func (c *curtainConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("has no name")
+	}
+
+	if c.IP == nil {
+		return fmt.Errorf("has no ip")
+	}
+
+	_, err := net.ParseMAC(c.MAC)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *curtainConfig) devType() int {
+	if c.Type == 0 {
+		return defaultDooyaType
+	}
+
+	return c.Type
+}
+
+func (c *curtainConfig) key() string {
+	return c.ID
+}
+
+// sameDevice reports whether other addresses the same motor.
+func (c *curtainConfig) sameDevice(other *curtainConfig) bool {
+	return c.IP.Equal(other.IP) &&
+		c.MAC == other.MAC &&
+		c.devType() == other.devType()
+}
+
+// sameAccessory reports whether other would publish the same accessory.
+func (c *curtainConfig) sameAccessory(other *curtainConfig) bool {
+	return c.Name == other.Name
+}
+
+// curtain is a Dooya curtain motor published as a HomeKit window covering.
+// The motor can only open, close or stop, so a move to a position part way
+// is made by starting it and stopping it once it gets there.
+type curtain struct {
+	id   uint64
+	dev  *remoteDevice
+	log  *slog.Logger
+	stop chan struct{}
+
+	mu       sync.Mutex
+	cfg      curtainConfig
+	position int
+	target   int
+	moving   int // a PositionState value
+	cancel   chan struct{}
+
+	// Service of the currently published accessory.
+	svc *service.WindowCovering
+}
+
+func newCurtain(id uint64, cfg curtainConfig, log *slog.Logger) *curtain {
+	dev := newRemoteDevice("curtain", cfg.ID, cfg.IP, cfg.MAC, cfg.devType(), log)
+	dev.product = broadlink.ProductDooya
+
+	c := &curtain{
+		id:     id,
+		dev:    dev,
+		log:    log,
+		stop:   make(chan struct{}),
+		cfg:    cfg,
+		moving: characteristic.PositionStateStopped,
+	}
+
+	go c.run()
+
+	return c
+}
+
+func (c *curtain) config() curtainConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cfg
+}
+
+// update replaces the config of a curtain at the same address.
+func (c *curtain) update(cfg curtainConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cfg = cfg
+}
+
+// close stops polling, abandons any move and drops the curtain's metrics.
+func (c *curtain) close() {
+	close(c.stop)
+
+	c.mu.Lock()
+	if c.cancel != nil {
+		close(c.cancel)
+		c.cancel = nil
+	}
+	id := c.cfg.ID
+	c.mu.Unlock()
+
+	c.dev.close()
+	curtainPositionMetric.DeleteLabelValues(id)
+}
+
+func (c *curtain) run() {
+	pollEvery(plugPollInterval, c.stop, func() {
+		c.mu.Lock()
+		moving := c.cancel != nil
+		c.mu.Unlock()
+
+		// A move polls for itself.
+		if !moving {
+			c.poll()
+		}
+	})
+}
+
+// poll reads the position of the curtain and returns it.
+func (c *curtain) poll() (int, error) {
+	bl, err := c.dev.get()
+	if err != nil {
+		c.log.Warn(err.Error())
+		return 0, err
+	}
+
+	id := c.config().ID
+
+	pos, err := bl.CurtainPosition()
+	if err != nil {
+		c.log.Warn("error polling curtain", "error", err)
+		return 0, err
+	}
+
+	c.log.Debug("polled curtain", "position", pos)
+
+	curtainPositionMetric.WithLabelValues(id).Set(float64(pos))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.position = pos
+	if c.cancel == nil {
+		c.target = pos
+	}
+	c.updateChars()
+
+	return pos, nil
+}
+
+// updateChars pushes the believed state to the published accessory. c.mu
+// must be held.
+func (c *curtain) updateChars() {
+	if c.svc == nil {
+		return
+	}
+
+	c.svc.CurrentPosition.SetValue(c.position)
+	c.svc.TargetPosition.SetValue(c.target)
+	c.svc.PositionState.SetValue(c.moving)
+}
+
+// setTarget starts the curtain moving towards pos, abandoning any move
+// already under way.
+func (c *curtain) setTarget(pos int) error {
+	c.log.Debug("setting curtain", "target", pos)
+
+	bl, err := c.dev.get()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.cancel != nil {
+		close(c.cancel)
+	}
+	cancel := make(chan struct{})
+	c.cancel = cancel
+	c.target = pos
+	current := c.position
+	c.mu.Unlock()
+
+	// Fully open and fully closed are left to the motor's own limits.
+	opening := pos > current || pos >= 100
+	if opening {
+		err = bl.OpenCurtain()
+	} else {
+		err = bl.CloseCurtain()
+	}
+
+	if err != nil {
+		c.finish(cancel)
+		return err
+	}
+
+	c.mu.Lock()
+	c.moving = characteristic.PositionStateDecreasing
+	if opening {
+		c.moving = characteristic.PositionStateIncreasing
+	}
+	c.updateChars()
+	c.mu.Unlock()
+
+	go c.move(bl, pos, opening, cancel)
+
+	return nil
+}
+
+// move waits for the curtain to reach pos, then stops it.
+func (c *curtain) move(bl *broadlink.Device, pos int, opening bool, cancel chan struct{}) {
+	defer c.finish(cancel)
+
+	ticker := time.NewTicker(curtainMoveInterval)
+	defer ticker.Stop()
+
+	timeout := time.After(curtainMoveTimeout)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			c.log.Warn("curtain did not reach its target, stopping it", "target", pos)
+			bl.StopCurtain()
+			return
+		case <-cancel:
+			return
+		}
+
+		current, err := c.poll()
+		if err != nil {
+			continue
+		}
+
+		if pos <= 0 || pos >= 100 {
+			// The motor stops itself at either end.
+			if current == pos {
+				return
+			}
+
+			continue
+		}
+
+		if (opening && current >= pos) || (!opening && current <= pos) {
+			err = bl.StopCurtain()
+			if err != nil {
+				c.log.Error("error stopping curtain", "error", err)
+			}
+
+			return
+		}
+	}
+}
+
+// finish marks the move with the given cancel channel as over, unless
+// another has replaced it.
+func (c *curtain) finish(cancel chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel != cancel {
+		return
+	}
+
+	c.cancel = nil
+	c.moving = characteristic.PositionStateStopped
+	c.target = c.position
+	c.updateChars()
+}
+
+// accessory builds a HomeKit window covering from the current config and
+// state.
+func (c *curtain) accessory() *accessory.Accessory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := accessory.Info{
+		Name:         c.cfg.Name,
+		Manufacturer: "Dooya",
+		Model:        "DT360E",
+		SerialNumber: c.cfg.MAC,
+		ID:           c.id,
+	}
+
+	acc := accessory.New(info, accessory.TypeWindowCovering)
+
+	svc := service.NewWindowCovering()
+	svc.TargetPosition.OnValueRemoteUpdate(func(pos int) {
+		err := c.setTarget(pos)
+		if err != nil {
+			c.log.Error("error setting curtain target", "error", err)
+		}
+	})
+
+	acc.AddService(svc.Service)
+
+	c.svc = svc
+	c.updateChars()
+
+	return acc
+}
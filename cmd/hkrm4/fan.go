@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fanSpeedMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "fan",
+		Name:      "speed_fraction",
+		Help:      "Current fan speed.",
+	}, []string{"id"})
+
+	lightBrightnessMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "light",
+		Name:      "brightness_fraction",
+		Help:      "Current light brightness.",
+	}, []string{"id"})
+)
+
+// fan is a ceiling fan with a light, driven by IR codes. The believed state
+// lives here rather than in the HomeKit characteristics so that the
+// accessory can be rebuilt when the config changes.
+type fan struct {
+	bl      *serialHub
+	id      uint64
+	log     *slog.Logger
+	levels  *fanLevels
+	changed func(*fan)
+
+	mu      sync.Mutex
+	cfg     fanConfig
+	on      bool
+	speed   float64
+	lightOn bool
+
+	// level is the speed level last sent to the fan, 0 being off. For
+	// relative fans with a power code it is the level the fan returns to
+	// when powered, and powered says whether it is. Relative fans are
+	// tracked across restarts through levels.
+	level   int
+	powered bool
+
+	// pending sends the settled state once HomeKit updates stop arriving.
+	// flushing counts the sends scheduled or under way, so that shutdown
+	// can wait for them.
+	pending  *time.Timer
+	flushing sync.WaitGroup
+
+	// Characteristics of the currently published accessory, updated when
+	// the state is changed other than through HomeKit.
+	onChar    *characteristic.On
+	speedChar *characteristic.RotationSpeed
+	lightChar *characteristic.On
+}
+
+// fanState is the believed state of a fan.
+type fanState struct {
+	On    bool    `json:"on"`
+	Speed float64 `json:"speed"`
+	Light bool    `json:"light"`
+}
+
+// newFan creates a fan. changed is called whenever its believed state
+// changes, from whichever source.
+func newFan(bl *serialHub, id uint64, cfg fanConfig, levels *fanLevels, changed func(*fan), log *slog.Logger) *fan {
+	f := &fan{
+		bl:      bl,
+		id:      id,
+		log:     log,
+		levels:  levels,
+		changed: changed,
+		cfg:     cfg,
+	}
+
+	if l, ok := levels.get(cfg.ID); ok {
+		f.level = l.Level
+		f.powered = l.Powered
+	} else {
+		f.level = f.minLevel()
+	}
+
+	// A powered relative fan is known to be on at its level.
+	if f.cfg.relative() && (f.powered || f.cfg.Commands.Power == nil) && f.level > 0 {
+		f.on = true
+		f.speed = float64(f.level) * f.stepValue()
+	}
+
+	return f
+}
+
+func (f *fan) config() fanConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.cfg
+}
+
+// update replaces the fan's config, keeping its believed state.
+func (f *fan) update(cfg fanConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cfg = cfg
+}
+
+// remove drops the fan's metrics once it is no longer configured.
+func (f *fan) remove() {
+	f.mu.Lock()
+	f.cancelPending()
+	f.mu.Unlock()
+
+	fanSpeedMetric.DeleteLabelValues(f.cfg.ID)
+	lightBrightnessMetric.DeleteLabelValues(f.cfg.ID)
+}
+
+func (f *fan) state() fanState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return fanState{
+		On:    f.on,
+		Speed: f.speed,
+		Light: f.lightOn,
+	}
+}
+
+// stepValue returns the rotation speed covered by each speed level.
+func (f *fan) stepValue() float64 {
+	return 100.0 / float64(f.cfg.levels())
+}
+
+func (f *fan) setSpeed(tx hub, speed float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	step := int(speed / f.stepValue())
+
+	f.log.Debug("setting fan", "speed", speed, "level", step)
+
+	fanSpeedMetric.WithLabelValues(f.cfg.ID).Set(math.Min(speed/100.0, 1.0))
+
+	return f.driveTo(tx, step)
+}
+
+// minLevel returns the lowest level a relative fan can be pressed down to.
+// With a power code the fan is turned off separately, so this is the
+// slowest speed rather than off. f.mu must be held.
+func (f *fan) minLevel() int {
+	if f.cfg.relative() && f.cfg.Commands.Power != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// driveTo sends the codes to move the fan to a speed level, either the code
+// for that level or enough speedUp or speedDown presses. Levels out of
+// range are clamped. f.mu must be held.
+func (f *fan) driveTo(tx hub, level int) error {
+	level = max(0, min(level, f.cfg.levels()))
+
+	if !f.cfg.relative() {
+		err := f.send(tx, fmt.Sprintf("speed%d", level), f.cfg.Commands.Speed[level])
+		if err != nil {
+			return err
+		}
+
+		f.level = level
+		return nil
+	}
+
+	defer f.saveLevel()
+
+	if power := f.cfg.Commands.Power; power != nil {
+		on := level > 0
+		if on != f.powered {
+			err := f.send(tx, "power", *power)
+			if err != nil {
+				return err
+			}
+
+			f.powered = on
+		}
+
+		if !on {
+			return nil
+		}
+	}
+
+	for f.level != level {
+		name, cmd, step := "speedUp", f.cfg.Commands.SpeedUp, 1
+		if level < f.level {
+			name, cmd, step = "speedDown", f.cfg.Commands.SpeedDown, -1
+		}
+
+		err := f.send(tx, name, *cmd)
+		if err != nil {
+			return err
+		}
+
+		f.level += step
+	}
+
+	return nil
+}
+
+// send transmits one of the fan's commands, given by name, through tx.
+func (f *fan) send(tx hub, name string, c command) error {
+	countSend(f.cfg.ID, name)
+	return c.send(tx)
+}
+
+// saveLevel persists the believed level of a relative fan. f.mu must be
+// held.
+func (f *fan) saveLevel() {
+	err := f.levels.set(f.cfg.ID, fanLevel{Level: f.level, Powered: f.powered})
+	if err != nil {
+		f.log.Error("error saving fan level", "error", err)
+	}
+}
+
+// home resynchronises a relative fan whose believed level has drifted, by
+// pressing speedDown often enough to reach the lowest level from anywhere
+// and then driving it back to the believed state. A fan with a power code
+// must be running for the presses to register, so one believed off is
+// powered on first and turned off again afterwards.
+func (f *fan) home() error {
+	return f.bl.exclusive(func(tx hub) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if !f.cfg.relative() {
+			return fmt.Errorf("fan %q does not use relative speed control", f.cfg.ID)
+		}
+
+		defer f.saveLevel()
+
+		f.cancelPending()
+
+		f.log.Debug("homing fan")
+
+		if power := f.cfg.Commands.Power; power != nil && !f.powered {
+			err := f.send(tx, "power", *power)
+			if err != nil {
+				return err
+			}
+
+			f.powered = true
+		}
+
+		for i := 0; i < f.cfg.levels(); i++ {
+			err := f.send(tx, "speedDown", *f.cfg.Commands.SpeedDown)
+			if err != nil {
+				return err
+			}
+		}
+
+		f.level = f.minLevel()
+
+		target := 0
+		if f.on {
+			target = int(f.speed / f.stepValue())
+		}
+
+		return f.driveTo(tx, target)
+	})
+}
+
+// debounce returns how long HomeKit changes must settle before sending.
+func (f *fan) debounce() time.Duration {
+	if f.cfg.DebounceMs > 0 {
+		return time.Duration(f.cfg.DebounceMs) * time.Millisecond
+	}
+
+	return 500 * time.Millisecond
+}
+
+// schedule arranges for the believed state to be sent once HomeKit updates
+// have settled, replacing any send already scheduled. f.mu must be held.
+func (f *fan) schedule() {
+	// A stopped send hands its place in flushing on to the new one.
+	if f.pending == nil || !f.pending.Stop() {
+		f.flushing.Add(1)
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(f.debounce(), func() {
+		// f.mu is held until t is set.
+		f.mu.Lock()
+		fired := t
+		f.mu.Unlock()
+
+		f.flush(fired)
+	})
+	f.pending = t
+}
+
+// cancelPending drops a scheduled send. f.mu must be held.
+func (f *fan) cancelPending() {
+	if f.pending != nil {
+		if f.pending.Stop() {
+			f.flushing.Done()
+		}
+		f.pending = nil
+	}
+}
+
+// drain sends a scheduled change now rather than dropping it, and waits
+// for any send already under way to finish.
+func (f *fan) drain(ctx context.Context) error {
+	f.mu.Lock()
+	t := f.pending
+	pending := t != nil && t.Stop()
+	f.mu.Unlock()
+
+	if pending {
+		f.flush(t)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.flushing.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush sends the believed state for the scheduled send t.
+func (f *fan) flush(t *time.Timer) {
+	defer f.flushing.Done()
+
+	err := f.bl.exclusive(func(tx hub) error {
+		f.mu.Lock()
+		// A change may have scheduled another send while this one waited
+		// for the hub, which must be left for cancelPending and drain.
+		if f.pending == t {
+			f.pending = nil
+		}
+		speed := f.speed
+		if !f.on {
+			speed = 0
+		}
+		f.mu.Unlock()
+
+		return f.setSpeed(tx, speed)
+	})
+	if err != nil {
+		f.log.Error("error setting fan speed", "error", err)
+	}
+}
+
+// requestRotationSpeed handles a speed change from HomeKit. The believed
+// state changes at once but the code is only sent once the slider settles.
+func (f *fan) requestRotationSpeed(speed float64) {
+	f.mu.Lock()
+	f.speed = speed
+	f.schedule()
+	f.mu.Unlock()
+
+	f.changed(f)
+}
+
+// requestOn handles a power change from HomeKit, coalesced with any speed
+// change arriving alongside it.
+func (f *fan) requestOn(on bool) {
+	f.log.Debug("requested fan", "on", on)
+
+	f.mu.Lock()
+	f.on = on
+	f.schedule()
+	f.mu.Unlock()
+
+	f.changed(f)
+}
+
+func (f *fan) toggleLight(on bool) error {
+	return f.bl.exclusive(func(tx hub) error {
+		return f.sendLight(tx, on)
+	})
+}
+
+// sendLight toggles the light through tx.
+func (f *fan) sendLight(tx hub, on bool) error {
+	f.log.Debug("setting fan", "light", on)
+
+	defer f.changed(f)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lightOn = on
+
+	if on {
+		lightBrightnessMetric.WithLabelValues(f.cfg.ID).Set(1.0)
+	} else {
+		lightBrightnessMetric.WithLabelValues(f.cfg.ID).Set(0.0)
+	}
+
+	return f.send(tx, "lightToggle", f.cfg.Commands.LightToggle)
+}
+
+// set changes the fan's state through the same paths as HomeKit, and
+// updates the published characteristics so controllers see the change.
+// Fields left nil are unchanged, except that a speed given without on
+// turns the fan on or off, since sending a speed code starts it.
+func (f *fan) set(on *bool, speed *float64, light *bool) error {
+	return f.bl.exclusive(func(tx hub) error {
+		return f.setWith(tx, on, speed, light)
+	})
+}
+
+// setWith is set for a caller already holding the hub, sending through tx.
+func (f *fan) setWith(tx hub, on *bool, speed *float64, light *bool) error {
+	cur := f.state()
+
+	target := cur
+	if speed != nil {
+		target.Speed = *speed
+		target.On = *speed > 0
+	}
+
+	if on != nil {
+		target.On = *on
+	}
+
+	if speed != nil || target.On != cur.On {
+		f.log.Debug("setting fan", "on", target.On, "speed", target.Speed)
+
+		f.mu.Lock()
+		f.on, f.speed = target.On, target.Speed
+		f.cancelPending()
+		f.mu.Unlock()
+
+		send := target.Speed
+		if !target.On {
+			send = 0
+		}
+
+		err := f.setSpeed(tx, send)
+		f.changed(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The light code is a toggle, so only send it on a change.
+	if light != nil && *light != cur.Light {
+		err := f.sendLight(tx, *light)
+		if err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.onChar != nil {
+		f.onChar.SetValue(f.on)
+		f.speedChar.SetValue(f.speed)
+		f.lightChar.SetValue(f.lightOn)
+	}
+
+	return nil
+}
+
+// commands returns the fan's commands by name.
+func (f *fan) commands() map[string]command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.cfg.commands()
+}
+
+// logError adapts a state change function to a HomeKit update callback,
+// logging any error to log.
+func logError(log *slog.Logger, fn func(bool) error) func(bool) {
+	return func(v bool) {
+		err := fn(v)
+		if err != nil {
+			log.Error("error handling HomeKit update", "error", err)
+		}
+	}
+}
+
+// accessory builds a HomeKit accessory for the fan from its current config
+// and state.
+func (f *fan) accessory() *accessory.Accessory {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info := accessory.Info{
+		Name:             f.cfg.Name,
+		Manufacturer:     f.cfg.Manufacturer,
+		Model:            f.cfg.Model,
+		FirmwareRevision: f.cfg.FirmwareRevision,
+		SerialNumber:     f.cfg.SerialNumber,
+		ID:               f.id,
+	}
+
+	acc := accessory.New(info, accessory.TypeFan)
+
+	fan := service.NewFan()
+	fan.On.SetValue(f.on)
+
+	speed := characteristic.NewRotationSpeed()
+	speed.SetMaxValue(100.0)
+	speed.SetMinValue(0.0)
+	speed.SetStepValue(f.stepValue())
+	speed.SetValue(f.speed)
+
+	speed.OnValueRemoteUpdate(f.requestRotationSpeed)
+	fan.AddCharacteristic(speed.Characteristic)
+
+	fan.On.OnValueRemoteUpdate(f.requestOn)
+
+	light := service.NewLightbulb()
+	light.On.SetValue(f.lightOn)
+	light.On.OnValueRemoteUpdate(logError(f.log, f.toggleLight))
+
+	acc.AddService(fan.Service)
+	acc.AddService(light.Service)
+
+	f.onChar = fan.On
+	f.speedChar = speed
+	f.lightChar = light.On
+
+	return acc
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+// Codes of the relative fan under test, told apart in what the hub sent.
+var relativeCodes = map[string]string{
+	"aa01": "speedUp",
+	"aa02": "speedDown",
+	"aa03": "power",
+	"aa04": "lightToggle",
+}
+
+func relativeFanConfig(power bool) fanConfig {
+	cfg := fanConfig{ID: "bed", Name: "Bedroom Fan", SpeedMode: speedModeRelative, Levels: 3}
+	cfg.Commands.LightToggle = command{Code: code{0xaa, 0x04}}
+	cfg.Commands.SpeedUp = &command{Code: code{0xaa, 0x01}}
+	cfg.Commands.SpeedDown = &command{Code: code{0xaa, 0x02}}
+	if power {
+		cfg.Commands.Power = &command{Code: code{0xaa, 0x03}}
+	}
+
+	return cfg
+}
+
+// sentNames returns the names of the codes sent through h.
+func sentNames(h *fakeHub) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	names := make([]string, len(h.sent))
+	for i, s := range h.sent {
+		names[i] = relativeCodes[s]
+		if names[i] == "" {
+			names[i] = s
+		}
+	}
+
+	return names
+}
+
+func TestRelativeFan(t *testing.T) {
+	on, off := true, false
+	speed := func(s float64) *float64 { return &s }
+
+	tests := []struct {
+		name   string
+		power  bool
+		stored *fanLevel
+		run    func(f *fan) error
+
+		// want is the sequence of codes sent, and wantLevel what is
+		// persisted afterwards.
+		want      []string
+		wantLevel fanLevel
+	}{
+		{
+			name:      "speed up from off",
+			run:       func(f *fan) error { return f.set(nil, speed(100), nil) },
+			want:      []string{"speedUp", "speedUp", "speedUp"},
+			wantLevel: fanLevel{Level: 3},
+		},
+		{
+			name:      "stored level is picked up",
+			stored:    &fanLevel{Level: 2},
+			run:       func(f *fan) error { return f.set(nil, speed(34), nil) },
+			want:      []string{"speedDown"},
+			wantLevel: fanLevel{Level: 1},
+		},
+		{
+			name:      "turn off without power",
+			stored:    &fanLevel{Level: 2},
+			run:       func(f *fan) error { return f.set(&off, nil, nil) },
+			want:      []string{"speedDown", "speedDown"},
+			wantLevel: fanLevel{Level: 0},
+		},
+		{
+			name:      "power on then speed up",
+			power:     true,
+			run:       func(f *fan) error { return f.set(&on, speed(100), nil) },
+			want:      []string{"power", "speedUp", "speedUp"},
+			wantLevel: fanLevel{Level: 3, Powered: true},
+		},
+		{
+			name:      "power off keeps the level",
+			power:     true,
+			stored:    &fanLevel{Level: 3, Powered: true},
+			run:       func(f *fan) error { return f.set(&off, nil, nil) },
+			want:      []string{"power"},
+			wantLevel: fanLevel{Level: 3},
+		},
+		{
+			name:      "power on returns to the stored level",
+			power:     true,
+			stored:    &fanLevel{Level: 2},
+			run:       func(f *fan) error { return f.set(&on, speed(67), nil) },
+			want:      []string{"power"},
+			wantLevel: fanLevel{Level: 2, Powered: true},
+		},
+		{
+			name:      "home without power",
+			stored:    &fanLevel{Level: 2},
+			run:       func(f *fan) error { return f.home() },
+			want:      []string{"speedDown", "speedDown", "speedDown", "speedUp", "speedUp"},
+			wantLevel: fanLevel{Level: 2},
+		},
+		{
+			name:      "home while off without power",
+			run:       func(f *fan) error { return f.home() },
+			want:      []string{"speedDown", "speedDown", "speedDown"},
+			wantLevel: fanLevel{Level: 0},
+		},
+		{
+			name:      "home while powered",
+			power:     true,
+			stored:    &fanLevel{Level: 2, Powered: true},
+			run:       func(f *fan) error { return f.home() },
+			want:      []string{"speedDown", "speedDown", "speedDown", "speedUp"},
+			wantLevel: fanLevel{Level: 2, Powered: true},
+		},
+		{
+			// Presses are ignored while the fan is off, so it is powered
+			// for homing and then turned off again.
+			name:      "home while believed off",
+			power:     true,
+			stored:    &fanLevel{Level: 3},
+			run:       func(f *fan) error { return f.home() },
+			want:      []string{"power", "speedDown", "speedDown", "speedDown", "power"},
+			wantLevel: fanLevel{Level: 1},
+		},
+		{
+			name:      "light is not a speed press",
+			run:       func(f *fan) error { return f.set(nil, nil, &on) },
+			want:      []string{"lightToggle"},
+			wantLevel: fanLevel{Level: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := relativeFanConfig(tt.power)
+
+			levels, err := loadFanLevels(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.stored != nil {
+				err = levels.set(cfg.ID, *tt.stored)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			h := &fakeHub{}
+			log := slog.New(slog.NewTextHandler(io.Discard, nil))
+			f := newFan(&serialHub{hub: h}, 1, cfg, levels, func(*fan) {}, log)
+
+			err = tt.run(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sentNames(h); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %v, want %v", got, tt.want)
+			}
+
+			// The level survives a restart.
+			reloaded, err := loadFanLevels(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, _ := reloaded.get(cfg.ID)
+			if got != tt.wantLevel {
+				t.Errorf("stored level %+v, want %+v", got, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestRelativeFanRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := relativeFanConfig(true)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	levels, err := loadFanLevels(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	on := true
+	speed := 67.0
+	f := newFan(&serialHub{hub: &fakeHub{}}, 1, cfg, levels, func(*fan) {}, log)
+	err = f.set(&on, &speed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new fan over the same data directory believes the fan is still on
+	// at the same level, so one press down is enough.
+	levels, err = loadFanLevels(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &fakeHub{}
+	f = newFan(&serialHub{hub: h}, 1, cfg, levels, func(*fan) {}, log)
+	if st := f.state(); !st.On {
+		t.Errorf("restarted fan is believed off")
+	}
+
+	speed = 34
+	err = f.set(nil, &speed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := sentNames(h), []string{"speedDown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v after restart, want %v", got, want)
+	}
+}
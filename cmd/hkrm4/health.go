@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const healthCheckInterval = 30 * time.Second
+
+// healthCheck pings a device in the background and records whether it
+// answered in hkrm4_device_up.
+type healthCheck struct {
+	device string
+	ping   func() error
+	log    *slog.Logger
+	stop   chan struct{}
+
+	mu   sync.Mutex
+	up   bool
+	last time.Time
+}
+
+// newHealthCheck checks the device named device, e.g. "hub", with ping.
+func newHealthCheck(device string, ping func() error, log *slog.Logger) *healthCheck {
+	return &healthCheck{
+		device: device,
+		ping:   ping,
+		log:    log,
+		stop:   make(chan struct{}),
+	}
+}
+
+func (h *healthCheck) check() {
+	err := h.ping()
+	up := err == nil
+
+	h.mu.Lock()
+	was := h.up
+	h.up, h.last = up, time.Now()
+	h.mu.Unlock()
+
+	v := 0.0
+	if up {
+		v = 1
+	}
+
+	deviceUpMetric.WithLabelValues(h.device).Set(v)
+
+	if !up {
+		h.log.Warn("health check failed", "error", err)
+	} else if !was {
+		h.log.Debug("health check passed")
+	}
+}
+
+// status reports whether the device answered the last check, and when
+// that was.
+func (h *healthCheck) status() (bool, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.up, h.last
+}
+
+// run checks the device until close is called.
+func (h *healthCheck) run() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		h.check()
+
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *healthCheck) close() {
+	close(h.stop)
+}
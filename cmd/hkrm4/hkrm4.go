@@ -1,55 +1,39 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
+	"fmt"
 	"log"
-	"math"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/benpye/hkrm4/internal/broadlink"
 	"github.com/brutella/hc"
-	"github.com/brutella/hc/accessory"
-	"github.com/brutella/hc/characteristic"
-	"github.com/brutella/hc/service"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type fanConfig struct {
-	ID               string `json:"id"`
-	Name             string `json:"name"`
-	Manufacturer     string `json:"manufacturer"`
-	Model            string `json:"model"`
-	FirmwareRevision string `json:"firmwareRevision"`
-	SerialNumber     string `json:"serialNumber"`
-	Commands         struct {
-		LightToggle []byte   `json:"lightToggle"`
-		Speed       [][]byte `json:"speed"`
-	} `json:"commands"`
-}
-
-type config struct {
-	IP   net.IP `json:"ip"`
-	MAC  string `json:"mac"`
-	Type int    `json:"type"`
-
-	Fans []fanConfig `json:"fans"`
-}
+// shutdownTimeout bounds how long hkrm4 waits for HTTP requests and queued
+// macros when stopping.
+const shutdownTimeout = 10 * time.Second
 
 type sensorCollector struct {
 	bl                *broadlink.Device
+	log               *slog.Logger
 	humidityMetric    *prometheus.Desc
 	temperatureMetric *prometheus.Desc
 }
 
-var verbose *bool
-
-func newSensorCollector(bl *broadlink.Device) *sensorCollector {
+func newSensorCollector(bl *broadlink.Device, log *slog.Logger) *sensorCollector {
 	return &sensorCollector{
 		bl:                bl,
+		log:               log,
 		humidityMetric:    prometheus.NewDesc("sensor_relative_humidity_percentage", "Relative humidity in percent.", nil, nil),
 		temperatureMetric: prometheus.NewDesc("sensor_temperature_celsius", "Temperature in degrees celsius.", nil, nil),
 	}
@@ -62,258 +46,296 @@ func (c *sensorCollector) Describe(ch chan<- *prometheus.Desc) {
 
 //Collect implements required collect function for all promehteus collectors
 func (c *sensorCollector) Collect(ch chan<- prometheus.Metric) {
-	if *verbose {
-		log.Print("collecting sensor metrics")
-	}
-
 	temp, hum, err := c.bl.CheckSensors()
 	if err != nil {
-		log.Print(err)
+		c.log.Warn("error collecting sensor metrics", "error", err)
 		return
 	}
 
-	if *verbose {
-		log.Printf("temperature: %f, humidity: %f", temp, hum)
-	}
+	c.log.Debug("collected sensor metrics", "temperature", temp, "humidity", hum)
 
 	ch <- prometheus.MustNewConstMetric(c.humidityMetric, prometheus.GaugeValue, hum)
 	ch <- prometheus.MustNewConstMetric(c.temperatureMetric, prometheus.GaugeValue, temp)
 }
 
 func main() {
-	configPath := flag.String("config", "config.json", "Path of config file.")
-	data := flag.String("data", "data", "Path to store persistent data.")
-	port := flag.String("port", "", "Listening port - by default randomised.")
-	pin := flag.String("pin", "00102003", "PIN used for HomeKit pairing.")
-	metricsPort := flag.String("metrics", "", "Metrics listening port - disabled if not specified.")
-	verbose = flag.Bool("verbose", false, "Verbose logging.")
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfigCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "macro" {
+		runMacroCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "provision" {
+		runProvisionCommand(os.Args[2:])
+		return
+	}
+
+	configPath := flag.String("config", "config.json", "Path of config file (.json, .yaml, .yml or .toml).")
+	flag.String("ip", "", "IP address of the device.")
+	flag.String("mac", "", "MAC address of the device.")
+	flag.String("type", "", "Device type code, e.g. 0x6026.")
+	flag.String("data", "", "Path to store persistent data - by default \"data\".")
+	flag.String("port", "", "Listening port - by default randomised.")
+	flag.String("pin", "", "PIN used for HomeKit pairing - by default generated on first run.")
+	flag.String("pin-file", "", "Path of a file containing the PIN used for HomeKit pairing.")
+	flag.String("metrics", "", "Metrics and setup QR code listening port - disabled if not specified.")
+	flag.String("api", "", "Control API listening port - by default the metrics port.")
+	flag.String("api-token", "", "Bearer token for the control API - the API is disabled if not specified.")
+	flag.String("api-token-file", "", "Path of a file containing the bearer token for the control API.")
+	flag.String("mqtt", "", "MQTT broker URL, e.g. tcp://localhost:1883 - disabled if not specified.")
+	flag.String("mqtt-username", "", "MQTT username.")
+	flag.String("mqtt-password", "", "MQTT password.")
+	flag.String("mqtt-password-file", "", "Path of a file containing the MQTT password.")
+	flag.String("mqtt-prefix", "", "MQTT topic prefix - by default \"hkrm4\".")
+	flag.String("mqtt-discovery-prefix", "", "Home Assistant MQTT discovery prefix - by default \"homeassistant\".")
+	flag.String("min-interval-ms", "", "Minimum time between transmissions on the hub, in milliseconds.")
+	flag.String("device-models-file", "", "Path of a JSON file of extra device models.")
+	flag.String("local-addr", "", "Local address and port to talk to devices from, e.g. 0.0.0.0:40000 - by default any.")
+	flag.String("ready-max-age-seconds", "", "How recently the hub's sensors must have been read for /readyz to report ready - by default 180.")
+	flag.Bool("verbose", false, "Verbose logging - the same as -log-level debug.")
+	flag.String("log-level", "", "Log level: trace, debug, info, warn or error - by default info.")
+	flag.String("log-format", "", "Log format: text or json - by default text.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n       %s config convert <input> <output>\n       %s macro list|run <id>\n       %s provision <ssid>\n\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Settings are read from the config file, then from %s* environment\nvariables (e.g. %s), then from flags.\n\n", envPrefix, envName("pin-file"))
+		flag.PrintDefaults()
+	}
 
 	flag.Parse()
 
-	configFile, err := os.Open(*configPath)
+	if v, ok := os.LookupEnv(envName("config")); ok && !isFlagSet(flag.CommandLine, "config") {
+		*configPath = v
+	}
+
+	o := collectOverrides(flag.CommandLine)
+
+	cfg, err := loadConfig(*configPath, o)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer configFile.Close()
+	logLevel.Set(cfg.logLevel())
+	logger := newLogger(cfg.LogFormat)
+	slog.SetDefault(logger)
 
-	configDecoder := json.NewDecoder(configFile)
+	mac, err := net.ParseMAC(cfg.MAC)
+	if err != nil {
+		fatal(err)
+	}
 
-	var cfg config
-	err = configDecoder.Decode(&cfg)
+	err = registerModels(broadlink.DefaultRegistry, cfg)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	mac, err := net.ParseMAC(cfg.MAC)
+	err = checkModels(broadlink.DefaultRegistry, cfg)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	if cfg.LocalAddr != "" {
+		deviceOptions = append(deviceOptions, broadlink.LocalAddr(cfg.LocalAddr))
 	}
 
-	bl, err := broadlink.NewDevice(cfg.IP, mac, cfg.Type)
+	hubLog := logger.With("device", "hub")
+	opts := append([]broadlink.Option{broadlink.WithLogger(hubLog), broadlink.WithObserver(deviceMetrics("hub"))}, deviceOptions...)
+	bl, err := broadlink.NewDevice(cfg.IP, mac, cfg.Type, opts...)
 	if err != nil {
-		log.Fatal(err)
+		fatal(connectError(fmt.Sprintf("the hub at %v", cfg.IP), err))
+	}
+
+	err = checkCapabilities(bl.Info(), cfg)
+	if err != nil {
+		fatal(err)
 	}
 
-	newFan := func(config fanConfig) *accessory.Accessory {
-		info := accessory.Info{
-			Name:             config.Name,
-			Manufacturer:     config.Manufacturer,
-			Model:            config.Model,
-			FirmwareRevision: config.FirmwareRevision,
-			SerialNumber:     config.SerialNumber,
+	if cfg.Metrics != "" {
+		prometheus.MustRegister(fanSpeedMetric, lightBrightnessMetric, plugPowerMetric, stripSocketMetric, curtainPositionMetric)
+		for _, m := range append(a1Metrics, thermostatMetrics...) {
+			prometheus.MustRegister(m)
 		}
 
-		acc := accessory.New(info, accessory.TypeFan)
+		prometheus.MustRegister(ioMetrics...)
+		prometheus.MustRegister(newPairedControllersMetric(cfg.Data))
+	}
 
-		fan := service.NewFan()
-		fan.On.SetValue(false)
+	setup, err := loadSetupInfo(cfg.Data, cfg.Pin)
+	if err != nil {
+		fatal(err)
+	}
 
-		speed := characteristic.NewRotationSpeed()
+	transportConfig := hc.Config{
+		Pin:         setup.Pin,
+		SetupId:     setup.SetupID,
+		Port:        cfg.Port,
+		StoragePath: cfg.Data,
+	}
 
-		minVal := 0.0
-		maxVal := 100.0
+	srv, err := newServer(bl, transportConfig, logger)
+	if err != nil {
+		fatal(err)
+	}
 
-		numSteps := len(config.Commands.Speed) - 1
-		stepVal := maxVal / float64(numSteps)
+	_, err = srv.apply(cfg)
+	if err != nil {
+		fatal(err)
+	}
 
-		speed.SetMaxValue(maxVal)
-		speed.SetMinValue(minVal)
-		speed.SetStepValue(stepVal)
+	err = srv.start()
+	if err != nil {
+		fatal(err)
+	}
 
-		speedMetric := prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace:   "hkrm4",
-			Subsystem:   "fan",
-			Name:        "speed_fraction",
-			Help:        "Current fan speed.",
-			ConstLabels: prometheus.Labels{"id": config.ID},
-		})
+	setup.printSetup()
 
-		lightMetric := prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace:   "hkrm4",
-			Subsystem:   "light",
-			Name:        "brightness_fraction",
-			Help:        "Current light brightness.",
-			ConstLabels: prometheus.Labels{"id": config.ID},
-		})
+	poller := newSensorPoller(hubLog, hubSensors(bl))
+	poller.subscribe(srv.updateSensors)
 
-		setSpeed := func(speed float64) {
-			step := int(speed / stepVal)
+	var mqttBridge *mqttBridge
+	if cfg.MQTT != "" {
+		mqttBridge = newMQTTBridge(cfg, srv, poller, logger.With("component", "mqtt"))
+		mqttBridge.connect()
+	}
 
-			if *verbose {
-				log.Printf("setting speed to %f (%d)", speed, step)
-			}
+	go poller.run()
 
-			speedMetric.Set(math.Min(speed/100.0, 1.0))
+	health := newHealthCheck("hub", bl.Ping, hubLog)
+	go health.run()
 
-			bl.SendData(config.Commands.Speed[step])
+	ready := newReadiness(bl, poller, time.Duration(cfg.ReadyMaxAgeSeconds)*time.Second)
+	go ready.notifySystemd(logger)
 
-			if err != nil {
-				log.Printf("error: %v", err)
-			}
+	muxes := make(map[string]*http.ServeMux)
+	muxFor := func(port string) *http.ServeMux {
+		if muxes[port] == nil {
+			muxes[port] = http.NewServeMux()
 		}
 
-		speed.OnValueRemoteUpdate(setSpeed)
-		fan.AddCharacteristic(speed.Characteristic)
+		return muxes[port]
+	}
 
-		fan.On.OnValueRemoteUpdate(func(on bool) {
-			if *verbose {
-				log.Printf("fan on = %v", on)
-			}
+	if cfg.Metrics != "" {
+		mux := muxFor(cfg.Metrics)
 
-			if on {
-				setSpeed(speed.GetValue())
-			} else {
-				setSpeed(0)
-			}
+		prometheus.MustRegister(newSensorCollector(bl, hubLog))
 
-			if err != nil {
-				log.Printf("error: %v", err)
-			}
-		})
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/setup.png", setup.unpairedQRHandler(cfg.Data))
+	}
 
-		light := service.NewLightbulb()
+	if cfg.APIToken != "" {
+		mux := muxFor(cfg.apiPort())
+		newAPI(srv, cfg.APIToken, setup, *configPath).register(mux)
+		mux.Handle("/", webHandler())
+	}
 
-		light.On.SetValue(false)
-		light.On.OnValueRemoteUpdate(func(on bool) {
-			if *verbose {
-				log.Printf("light on = %v", on)
-			}
+	// Listeners are bound here rather than in ListenAndServe so that a port
+	// which is already in use stops hkrm4 instead of going unnoticed.
+	var httpServers []*http.Server
+	serveErr := make(chan error, len(muxes))
+	for port, mux := range muxes {
+		ready.register(mux)
+
+		httpServer := &http.Server{
+			Addr:    ":" + port,
+			Handler: mux,
+		}
+
+		ln, err := net.Listen("tcp", httpServer.Addr)
+		if err != nil {
+			serveErr <- fmt.Errorf("error listening on port %s: %v", port, err)
+			break
+		}
 
-			if on {
-				lightMetric.Set(1.0)
-			} else {
-				lightMetric.Set(0.0)
+		httpServers = append(httpServers, httpServer)
+		go func(port string) {
+			err := httpServer.Serve(ln)
+			if err != http.ErrServerClosed {
+				serveErr <- fmt.Errorf("error serving on port %s: %v", port, err)
 			}
+		}(port)
+	}
 
-			err = bl.SendData(config.Commands.LightToggle)
+	reload := make(chan struct{}, 1)
+	go watchConfig(*configPath, reload)
 
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	exitCode := 0
+loop:
+	for {
+		select {
+		case <-reload:
+			cfg, err := loadConfig(*configPath, o)
+			if err == nil {
+				err = checkModels(broadlink.DefaultRegistry, cfg)
+			}
+			if err == nil {
+				err = checkCapabilities(bl.Info(), cfg)
+			}
 			if err != nil {
-				log.Printf("error: %v", err)
+				logger.Warn("not reloading config", "error", err)
+				continue
 			}
-		})
 
-		acc.AddService(fan.Service)
-		acc.AddService(light.Service)
+			logLevel.Set(cfg.logLevel())
 
-		if *metricsPort != "" {
-			err = prometheus.Register(speedMetric)
+			err = srv.reload(cfg)
 			if err != nil {
-				log.Fatal(err)
+				fatal(err)
 			}
 
-			prometheus.Register(lightMetric)
-			if err != nil {
-				log.Fatal(err)
+			if mqttBridge != nil {
+				mqttBridge.refresh()
 			}
+		case sig := <-sigs:
+			logger.Info("received signal", "signal", sig.String())
+			break loop
+		case err := <-serveErr:
+			logger.Error(err.Error())
+			exitCode = 1
+			break loop
 		}
-
-		return acc
-	}
-
-	temp, hum, err := bl.CheckSensors()
-	if err != nil {
-		log.Fatal(err)
 	}
 
-	temperature := service.NewTemperatureSensor()
-	temperature.CurrentTemperature.Float.SetValue(temp)
-	temperature.CurrentTemperature.Float.OnValueRemoteGet(func() float64 {
-		if *verbose {
-			log.Print("query temperature")
-		}
-
-		temp, _, err := bl.CheckSensors()
-		if err != nil {
-			log.Print(err)
-		}
-
-		if *verbose {
-			log.Printf("temperature = %f", temp)
-		}
+	go func() {
+		<-sigs
+		logger.Warn("received second signal, exiting immediately")
+		os.Exit(1)
+	}()
 
-		return temp
-	})
+	logger.Info("shutting down")
+	sdNotify("STOPPING=1")
 
-	humidity := service.NewHumiditySensor()
-	humidity.CurrentRelativeHumidity.Float.SetValue(hum)
-	humidity.CurrentRelativeHumidity.Float.OnValueRemoteGet(func() float64 {
-		if *verbose {
-			log.Print("query humidity")
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-		_, hum, err := bl.CheckSensors()
+	for _, httpServer := range httpServers {
+		err := httpServer.Shutdown(ctx)
 		if err != nil {
-			log.Print(err)
-		}
-
-		if *verbose {
-			log.Printf("humidity = %f", hum)
+			logger.Warn("error shutting down http server", "addr", httpServer.Addr, "error", err)
 		}
-
-		return hum
-	})
-
-	var fans []*accessory.Accessory
-	for _, fanConfig := range cfg.Fans {
-		fans = append(fans, newFan(fanConfig))
-	}
-
-	info := accessory.Info{
-		Name:             "BroadLink RM4 Pro",
-		Manufacturer:     "BroadLink",
-		Model:            "RM4 Pro",
-		FirmwareRevision: "N/A",
-		SerialNumber:     "N/A",
-	}
-	bridge := accessory.NewBridge(info)
-
-	bridge.AddService(temperature.Service)
-	bridge.AddService(humidity.Service)
-
-	transportConfig := hc.Config{
-		Pin:         *pin,
-		Port:        *port,
-		StoragePath: *data,
 	}
 
-	transport, err := hc.NewIPTransport(transportConfig, bridge.Accessory, fans...)
-	if err != nil {
-		log.Fatal(err)
+	if mqttBridge != nil {
+		mqttBridge.close()
 	}
 
-	if *metricsPort != "" {
-		mux := http.NewServeMux()
-		metricsServer := &http.Server{
-			Addr:    ":" + *metricsPort,
-			Handler: mux,
-		}
-
-		prometheus.MustRegister(newSensorCollector(bl))
+	health.close()
+	poller.close()
 
-		mux.Handle("/metrics", promhttp.Handler())
-		go metricsServer.ListenAndServe()
-	}
+	// Stopping the transport unpublishes the bridge over mDNS. Fan levels
+	// and pairings are written as they change, so once pending fan changes
+	// have been sent there is nothing left to save.
+	srv.shutdown(ctx)
+	bl.Close()
 
-	transport.Start()
+	logger.Info("stopped")
+	os.Exit(exitCode)
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/brutella/hc/util"
+)
+
+const accessoryIDsKey = "accessoryIDs"
+
+// bridgeAccessoryID is the ID HAP requires for the bridge itself.
+const bridgeAccessoryID = 1
+
+// accessoryIDs maps config IDs to HomeKit accessory IDs. The map is stored
+// alongside the pairings in the data directory so that reordering or
+// removing entries in the config never reassigns an existing accessory.
+// IDs of removed accessories are not reused.
+type accessoryIDs struct {
+	storage util.Storage
+
+	mu   sync.Mutex
+	IDs  map[string]uint64 `json:"ids"`
+	Next uint64            `json:"next"`
+}
+
+func loadAccessoryIDs(dir string) (*accessoryIDs, error) {
+	storage, err := util.NewFileStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := &accessoryIDs{
+		storage: storage,
+		IDs:     make(map[string]uint64),
+		Next:    bridgeAccessoryID + 1,
+	}
+
+	b, err := storage.Get(accessoryIDsKey)
+	if err != nil || len(b) == 0 {
+		return ids, nil
+	}
+
+	err = json.Unmarshal(b, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// get returns the accessory ID for key, allocating and persisting a new one
+// if key has not been seen before.
+func (a *accessoryIDs) get(key string) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if id, ok := a.IDs[key]; ok {
+		return id, nil
+	}
+
+	id := a.Next
+	a.IDs[key] = id
+	a.Next++
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, a.storage.Set(accessoryIDsKey, b)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const fanLevelsKey = "fanLevels"
+
+// fanLevel is what a fan with relative speed control is believed to be
+// doing, which is all there is to go on when pressing up or down.
+type fanLevel struct {
+	Level   int  `json:"level"`
+	Powered bool `json:"powered"`
+}
+
+// fanLevels stores the believed levels of relative fans in the data
+// directory, so that a restart does not lose track of them. The file is
+// replaced rather than written through hc's storage, which does not
+// truncate and so corrupts a shorter value written over a longer one.
+type fanLevels struct {
+	path string
+
+	mu     sync.Mutex
+	levels map[string]fanLevel
+}
+
+func loadFanLevels(dir string) (*fanLevels, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &fanLevels{
+		path:   filepath.Join(dir, fanLevelsKey),
+		levels: make(map[string]fanLevel),
+	}
+
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil || len(b) == 0 {
+		return l, nil
+	}
+
+	err = json.Unmarshal(b, &l.levels)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *fanLevels) get(id string) (fanLevel, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v, ok := l.levels[id]
+	return v, ok
+}
+
+func (l *fanLevels) set(id string, v fanLevel) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cur, ok := l.levels[id]; ok && cur == v {
+		return nil
+	}
+
+	l.levels[id] = v
+
+	b, err := json.Marshal(l.levels)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(l.path, b)
+}
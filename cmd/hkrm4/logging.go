@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is the level hkrm4 logs at. It is shared by every logger so that
+// reloading the config can change it.
+var logLevel = new(slog.LevelVar)
+
+// newLogger returns the root logger, which writes to stderr in the given
+// format.
+func newLogger(format string) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level:       logLevel,
+		ReplaceAttr: replaceLevel,
+	}
+
+	if format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// replaceLevel names the trace level, which slog would print as DEBUG-4.
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if l, ok := a.Value.Any().(slog.Level); ok && l == broadlink.LevelTrace {
+			return slog.String(slog.LevelKey, "TRACE")
+		}
+	}
+
+	return a
+}
+
+// parseLogLevel parses trace, debug, info, warn or error.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return broadlink.LevelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+
+	return 0, fmt.Errorf("unknown log level %q, expected trace, debug, info, warn or error", s)
+}
+
+// logLevel returns the level the config asks for. Verbose is a shorthand
+// for debug, and is ignored if a level is given.
+func (c *config) logLevel() slog.Level {
+	if c.LogLevel == "" && c.Verbose {
+		return slog.LevelDebug
+	}
+
+	// The level was checked when the config was loaded.
+	l, _ := parseLogLevel(c.LogLevel)
+	return l
+}
+
+// fatal logs err and exits.
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
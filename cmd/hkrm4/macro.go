@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/service"
+)
+
+// duration is a time.Duration written as a string such as "2s" or "500ms"
+// in config files.
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// stepConfig is one step of a macro. Exactly one of Send, Delay, Repeat
+// and Set is given; Steps is the body of a Repeat.
+type stepConfig struct {
+	Send   string       `json:"send,omitempty" yaml:"send,omitempty" toml:"send,omitempty"`
+	Delay  duration     `json:"delay,omitempty" yaml:"delay,omitempty" toml:"delay,omitempty"`
+	Repeat int          `json:"repeat,omitempty" yaml:"repeat,omitempty" toml:"repeat,omitempty"`
+	Steps  []stepConfig `json:"steps,omitempty" yaml:"steps,omitempty" toml:"steps,omitempty"`
+	Set    *setConfig   `json:"set,omitempty" yaml:"set,omitempty" toml:"set,omitempty"`
+}
+
+// setConfig sets the state of an accessory as if from HomeKit. Fields left
+// out are unchanged.
+type setConfig struct {
+	Accessory string   `json:"accessory" yaml:"accessory" toml:"accessory"`
+	On        *bool    `json:"on,omitempty" yaml:"on,omitempty" toml:"on,omitempty"`
+	Speed     *float64 `json:"speed,omitempty" yaml:"speed,omitempty" toml:"speed,omitempty"`
+	Light     *bool    `json:"light,omitempty" yaml:"light,omitempty" toml:"light,omitempty"`
+}
+
+type macroConfig struct {
+	ID    string       `json:"id" yaml:"id" toml:"id"`
+	Name  string       `json:"name" yaml:"name" toml:"name"`
+	Steps []stepConfig `json:"steps" yaml:"steps" toml:"steps"`
+}
+
+// validate checks the steps against the command library and the
+// configured fans.
+func (s *stepConfig) validate(c *config) error {
+	actions := 0
+
+	if s.Send != "" {
+		actions++
+		if _, ok := c.Commands[s.Send]; !ok {
+			return fmt.Errorf("unknown command %q", s.Send)
+		}
+	}
+
+	if s.Delay != 0 {
+		actions++
+		if s.Delay < 0 {
+			return fmt.Errorf("negative delay %v", time.Duration(s.Delay))
+		}
+	}
+
+	if s.Repeat != 0 {
+		actions++
+		if s.Repeat < 0 {
+			return fmt.Errorf("negative repeat count %d", s.Repeat)
+		}
+
+		if len(s.Steps) == 0 {
+			return fmt.Errorf("repeat has no steps")
+		}
+
+		for _, step := range s.Steps {
+			err := step.validate(c)
+			if err != nil {
+				return err
+			}
+		}
+	} else if len(s.Steps) > 0 {
+		return fmt.Errorf("steps are only allowed in a repeat")
+	}
+
+	if s.Set != nil {
+		actions++
+		if !c.hasFan(s.Set.Accessory) {
+			return fmt.Errorf("unknown accessory %q", s.Set.Accessory)
+		}
+
+		if s.Set.Speed != nil && (*s.Set.Speed < 0 || *s.Set.Speed > 100) {
+			return fmt.Errorf("speed must be between 0 and 100")
+		}
+	}
+
+	if actions != 1 {
+		return fmt.Errorf("each step needs exactly one of send, delay, repeat or set")
+	}
+
+	return nil
+}
+
+// hubQueue runs macros against a hub one at a time, in the order they were
+// started. Each holds the hub while it runs, so no other transmission is
+// interleaved with its steps.
+type hubQueue struct {
+	jobs chan func()
+	done chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newHubQueue() *hubQueue {
+	q := &hubQueue{
+		jobs: make(chan func(), 16),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		for job := range q.jobs {
+			job()
+		}
+		close(q.done)
+	}()
+
+	return q
+}
+
+// enqueue adds a job, failing rather than blocking if the queue is full.
+func (q *hubQueue) enqueue(job func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return fmt.Errorf("hub queue is closed")
+	}
+
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return fmt.Errorf("hub queue is full")
+	}
+}
+
+// close stops accepting jobs and waits for those already queued to run,
+// giving up when ctx is done.
+func (q *hubQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// macro is a named sequence of steps, published to HomeKit as a switch
+// which turns itself off once the macro has been queued.
+type macro struct {
+	srv *server
+	id  uint64
+	log *slog.Logger
+
+	mu  sync.Mutex
+	cfg macroConfig
+}
+
+func newMacro(srv *server, id uint64, cfg macroConfig, log *slog.Logger) *macro {
+	return &macro{
+		srv: srv,
+		id:  id,
+		log: log,
+		cfg: cfg,
+	}
+}
+
+func (m *macro) config() macroConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.cfg
+}
+
+func (m *macro) update(cfg macroConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cfg = cfg
+}
+
+// run queues the macro on the hub.
+func (m *macro) run() error {
+	cfg := m.config()
+
+	return m.srv.queue.enqueue(func() {
+		m.log.Debug("running macro")
+
+		err := m.srv.bl.exclusive(func(tx hub) error {
+			return m.srv.runSteps(tx, cfg.Steps)
+		})
+		if err != nil {
+			m.log.Error("error running macro", "error", err)
+		}
+	})
+}
+
+func (m *macro) accessory() *accessory.Accessory {
+	cfg := m.config()
+
+	info := accessory.Info{
+		Name:         cfg.Name,
+		Manufacturer: "hkrm4",
+		Model:        "Macro",
+		SerialNumber: cfg.ID,
+		ID:           m.id,
+	}
+
+	acc := accessory.New(info, accessory.TypeSwitch)
+
+	sw := service.NewSwitch()
+	sw.On.SetValue(false)
+	sw.On.OnValueRemoteUpdate(func(on bool) {
+		if !on {
+			return
+		}
+
+		err := m.run()
+		if err != nil {
+			m.log.Error("error queueing macro", "error", err)
+		}
+
+		// Reset shortly after so that the Home app shows the switch
+		// flicking on and back off.
+		time.AfterFunc(time.Second, func() {
+			sw.On.SetValue(false)
+		})
+	})
+
+	acc.AddService(sw.Service)
+
+	return acc
+}
+
+// runSteps executes macro steps in order, stopping at the first error. The
+// caller holds the hub, and codes are sent through tx.
+func (s *server) runSteps(tx hub, steps []stepConfig) error {
+	for _, step := range steps {
+		err := s.runStep(tx, step)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *server) runStep(tx hub, step stepConfig) error {
+	switch {
+	case step.Send != "":
+		c, ok := s.config().Commands[step.Send]
+		if !ok {
+			return fmt.Errorf("unknown command %q", step.Send)
+		}
+
+		s.log.Debug("sending command", "command", step.Send)
+		countSend("", step.Send)
+		return c.send(tx)
+	case step.Delay != 0:
+		time.Sleep(time.Duration(step.Delay))
+	case step.Repeat != 0:
+		for i := 0; i < step.Repeat; i++ {
+			err := s.runSteps(tx, step.Steps)
+			if err != nil {
+				return err
+			}
+		}
+	case step.Set != nil:
+		f := s.fan(step.Set.Accessory)
+		if f == nil {
+			return fmt.Errorf("unknown accessory %q", step.Set.Accessory)
+		}
+
+		return f.setWith(tx, step.Set.On, step.Set.Speed, step.Set.Light)
+	}
+
+	return nil
+}
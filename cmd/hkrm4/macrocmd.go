@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const macroUsage = "usage: hkrm4 macro [-config path] [-url url] list\n       hkrm4 macro [-config path] [-url url] run <id>"
+
+// runMacroCommand implements the "hkrm4 macro" subcommands, which list and
+// run macros through the control API of a running instance so that they
+// share its hub queue.
+func runMacroCommand(args []string) {
+	fs := flag.NewFlagSet("macro", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path of config file, used to find the control API and its token.")
+	baseURL := fs.String("url", "", "Base URL of the running instance - by default http://localhost:<api port>.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), macroUsage)
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if v, ok := os.LookupEnv(envName("config")); ok && !isFlagSet(fs, "config") {
+		*configPath = v
+	}
+
+	cfg, err := loadConfig(*configPath, collectOverrides(fs))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.APIToken == "" {
+		log.Fatal("the control API is not enabled, set an api token")
+	}
+
+	if *baseURL == "" {
+		*baseURL = "http://localhost:" + cfg.apiPort()
+	}
+
+	c := &apiClient{
+		base:  strings.TrimSuffix(*baseURL, "/") + strings.TrimSuffix(apiPrefix, "/"),
+		token: cfg.APIToken,
+	}
+
+	switch {
+	case fs.NArg() == 1 && fs.Arg(0) == "list":
+		var macros []macroInfo
+		err = c.do(http.MethodGet, "/macros", &macros)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, m := range macros {
+			fmt.Printf("%s\t%s\n", m.ID, m.Name)
+		}
+	case fs.NArg() == 2 && fs.Arg(0) == "run":
+		err = c.do(http.MethodPost, "/macros/"+url.PathEscape(fs.Arg(1))+"/run", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// apiClient calls the control API of a running instance.
+type apiClient struct {
+	base  string
+	token string
+}
+
+func (c *apiClient) do(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling hkrm4: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var e apiError
+		if json.NewDecoder(res.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("%s", e.Error)
+		}
+
+		return fmt.Errorf("unexpected response: %s", res.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
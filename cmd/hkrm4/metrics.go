@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deviceRequestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hkrm4",
+		Subsystem: "device",
+		Name:      "requests_total",
+		Help:      "Requests to Broadlink devices by command and result: ok, timeout, device_error or error.",
+	}, []string{"device", "command", "result"})
+
+	deviceRequestDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hkrm4",
+		Subsystem: "device",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken by requests to Broadlink devices.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"device", "command"})
+
+	deviceRetriesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hkrm4",
+		Subsystem: "device",
+		Name:      "retries_total",
+		Help:      "Packets sent again after a send failed.",
+	}, []string{"device"})
+
+	deviceReauthsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hkrm4",
+		Subsystem: "device",
+		Name:      "reauths_total",
+		Help:      "Times a device forgot its session and was authenticated again.",
+	}, []string{"device"})
+
+	deviceUpMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "device",
+		Name:      "up",
+		Help:      "Whether the device answered its last health check.",
+	}, []string{"device"})
+
+	sendsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hkrm4",
+		Name:      "sends_total",
+		Help:      "IR and RF codes sent, by accessory and command. Commands not belonging to an accessory have an empty accessory.",
+	}, []string{"accessory", "command"})
+
+	hapWritesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hkrm4",
+		Subsystem: "hap",
+		Name:      "writes_total",
+		Help:      "Characteristic values written by HomeKit controllers, by accessory and characteristic type.",
+	}, []string{"accessory", "characteristic"})
+)
+
+// ioMetrics are the metrics of device requests and HomeKit activity.
+var ioMetrics = []prometheus.Collector{
+	deviceRequestsMetric,
+	deviceRequestDurationMetric,
+	deviceRetriesMetric,
+	deviceReauthsMetric,
+	deviceUpMetric,
+	sendsMetric,
+	hapWritesMetric,
+}
+
+// newPairedControllersMetric counts the controllers paired with the bridge
+// whose pairings are stored in dataDir.
+func newPairedControllersMetric(dataDir string) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "hap",
+		Name:      "paired_controllers",
+		Help:      "HomeKit controllers paired with the bridge.",
+	}, func() float64 {
+		controllers, err := pairedControllers(dataDir)
+		if err != nil {
+			return 0
+		}
+
+		return float64(len(controllers))
+	})
+}
+
+// deviceMetrics records the requests of the device it names in metrics:
+// "hub" or the ID of the accessory a device belongs to.
+type deviceMetrics string
+
+func (m deviceMetrics) Request(command byte, result broadlink.Result, latency time.Duration) {
+	cmd := commandLabel(command)
+	deviceRequestsMetric.WithLabelValues(string(m), cmd, string(result)).Inc()
+	deviceRequestDurationMetric.WithLabelValues(string(m), cmd).Observe(latency.Seconds())
+}
+
+func (m deviceMetrics) Retry(command byte) {
+	deviceRetriesMetric.WithLabelValues(string(m)).Inc()
+}
+
+func (m deviceMetrics) Reauth() {
+	deviceReauthsMetric.WithLabelValues(string(m)).Inc()
+}
+
+func commandLabel(command byte) string {
+	return fmt.Sprintf("0x%02x", command)
+}
+
+// countSend records that an accessory's command was sent.
+func countSend(accessory, command string) {
+	sendsMetric.WithLabelValues(accessory, command).Inc()
+}
+
+// countWrites counts the values HomeKit controllers write to the
+// characteristics of acc, which belongs to the accessory with the given ID.
+func countWrites(id string, acc *accessory.Accessory) *accessory.Accessory {
+	for _, svc := range acc.GetServices() {
+		for _, c := range svc.GetCharacteristics() {
+			if !c.IsWritable() {
+				continue
+			}
+
+			typ := c.Type
+			c.OnValueUpdateFromConn(func(_ net.Conn, _ *characteristic.Characteristic, _, _ interface{}) {
+				hapWritesMetric.WithLabelValues(id, typ).Inc()
+			})
+		}
+	}
+
+	return acc
+}
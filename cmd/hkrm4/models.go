@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+)
+
+// modelConfig describes a device model missing from the built-in table, such
+// as a new RM4 hardware revision, so that it can be used without
+// recompiling.
+type modelConfig struct {
+	Type  int    `json:"type" yaml:"type" toml:"type"`
+	Name  string `json:"name" yaml:"name" toml:"name"`
+	IR    bool   `json:"ir,omitempty" yaml:"ir,omitempty" toml:"ir,omitempty"`
+	RF    bool   `json:"rf,omitempty" yaml:"rf,omitempty" toml:"rf,omitempty"`
+	Power bool   `json:"power,omitempty" yaml:"power,omitempty" toml:"power,omitempty"`
+
+	Environment bool `json:"environment,omitempty" yaml:"environment,omitempty" toml:"environment,omitempty"`
+	Sockets     int  `json:"sockets,omitempty" yaml:"sockets,omitempty" toml:"sockets,omitempty"`
+
+	// The headers are hex, e.g. "0400" and "d000" for the RM4 family.
+	RequestHeader     broadlink.Header `json:"requestHeader,omitempty" yaml:"requestHeader,omitempty" toml:"requestHeader,omitempty"`
+	CodeSendingHeader broadlink.Header `json:"codeSendingHeader,omitempty" yaml:"codeSendingHeader,omitempty" toml:"codeSendingHeader,omitempty"`
+
+	SensorScale int `json:"sensorScale,omitempty" yaml:"sensorScale,omitempty" toml:"sensorScale,omitempty"`
+}
+
+func (m *modelConfig) validate() error {
+	// 0 is the SP1, so a model without a type would silently replace it.
+	if m.Type <= 0 {
+		return fmt.Errorf("has no type")
+	}
+
+	if m.Name == "" {
+		return fmt.Errorf("has no name")
+	}
+
+	if m.SensorScale < 0 {
+		return fmt.Errorf("has a negative sensorScale")
+	}
+
+	return nil
+}
+
+func (m *modelConfig) model() broadlink.Model {
+	return broadlink.Model{
+		Type:              m.Type,
+		Name:              m.Name,
+		Supported:         true,
+		IR:                m.IR,
+		RF:                m.RF,
+		Power:             m.Power,
+		Environment:       m.Environment,
+		Sockets:           m.Sockets,
+		RequestHeader:     m.RequestHeader,
+		CodeSendingHeader: m.CodeSendingHeader,
+		SensorScale:       m.SensorScale,
+	}
+}
+
+// registerModels adds the models from the device models file and then the
+// config itself to the registry, replacing built-in models of the same
+// type.
+func registerModels(r *broadlink.Registry, cfg *config) error {
+	if cfg.DeviceModelsFile != "" {
+		err := r.LoadFile(cfg.DeviceModelsFile)
+		if err != nil {
+			return fmt.Errorf("error loading device models: %v", err)
+		}
+	}
+
+	for _, mc := range cfg.DeviceModels {
+		if cur, ok := r.Lookup(mc.Type); ok {
+			slog.Info("device model replaces an existing one", "model", mc.Name, "replaces", cur.Name, "type", fmt.Sprintf("0x%04x", mc.Type))
+		}
+
+		r.Set(mc.model())
+	}
+
+	return nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultMQTTPrefix          = "hkrm4"
+	defaultMQTTDiscoveryPrefix = "homeassistant"
+)
+
+// mqttBridge mirrors fan and hub sensor state to MQTT and accepts commands,
+// publishing Home Assistant discovery payloads for each entity. Commands
+// go through the same fan methods as HomeKit. Devices hkrm4 connects to
+// directly, such as plugs and A1 sensors, are not bridged.
+type mqttBridge struct {
+	srv             *server
+	log             *slog.Logger
+	poller          *sensorPoller
+	client          mqtt.Client
+	prefix          string
+	discoveryPrefix string
+
+	mu        sync.Mutex
+	published map[string]bool // fan IDs with discovery payloads
+}
+
+// haDevice is the device block of a Home Assistant discovery payload.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+// haEntity is a Home Assistant MQTT discovery payload. Only the fields used
+// by hkrm4 are included.
+type haEntity struct {
+	Name                   string   `json:"name"`
+	UniqueID               string   `json:"unique_id"`
+	Device                 haDevice `json:"device"`
+	AvailabilityTopic      string   `json:"availability_topic"`
+	StateTopic             string   `json:"state_topic,omitempty"`
+	CommandTopic           string   `json:"command_topic,omitempty"`
+	PercentageStateTopic   string   `json:"percentage_state_topic,omitempty"`
+	PercentageCommandTopic string   `json:"percentage_command_topic,omitempty"`
+	SpeedRangeMin          int      `json:"speed_range_min,omitempty"`
+	SpeedRangeMax          int      `json:"speed_range_max,omitempty"`
+	DeviceClass            string   `json:"device_class,omitempty"`
+	StateClass             string   `json:"state_class,omitempty"`
+	UnitOfMeasurement      string   `json:"unit_of_measurement,omitempty"`
+}
+
+func newMQTTBridge(cfg *config, srv *server, poller *sensorPoller, log *slog.Logger) *mqttBridge {
+	m := &mqttBridge{
+		srv:             srv,
+		log:             log,
+		poller:          poller,
+		prefix:          cfg.MQTTPrefix,
+		discoveryPrefix: cfg.MQTTDiscoveryPrefix,
+		published:       make(map[string]bool),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTT).
+		SetClientID("hkrm4-"+strings.ReplaceAll(cfg.MAC, ":", "")).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetWill(m.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			m.log.Warn("mqtt connection lost", "error", err)
+		})
+
+	m.client = mqtt.NewClient(opts)
+
+	srv.onFanChange(m.publishFan)
+	poller.subscribe(m.publishSensors)
+
+	return m
+}
+
+// connect starts connecting to the broker. Connection is retried in the
+// background, so this does not wait for the broker to be reachable.
+func (m *mqttBridge) connect() {
+	m.client.Connect()
+}
+
+// close marks the bridge offline and disconnects from the broker.
+func (m *mqttBridge) close() {
+	if m.client.IsConnected() {
+		t := m.client.Publish(m.availabilityTopic(), 1, true, "offline")
+		if t.WaitTimeout(time.Second) && t.Error() != nil {
+			m.log.Warn("error publishing", "topic", m.availabilityTopic(), "error", t.Error())
+		}
+	}
+
+	m.client.Disconnect(250)
+}
+
+func (m *mqttBridge) availabilityTopic() string {
+	return m.prefix + "/status"
+}
+
+func (m *mqttBridge) fanTopic(id, suffix string) string {
+	return m.prefix + "/fan/" + id + "/" + suffix
+}
+
+func (m *mqttBridge) hubTopic(suffix string) string {
+	return m.prefix + "/hub/" + defaultDeviceID + "/" + suffix
+}
+
+func (m *mqttBridge) publish(topic string, retained bool, payload interface{}) {
+	t := m.client.Publish(topic, 1, retained, payload)
+	go func() {
+		t.Wait()
+		if err := t.Error(); err != nil {
+			m.log.Warn("error publishing", "topic", topic, "error", err)
+		}
+	}()
+}
+
+func (m *mqttBridge) onConnect(c mqtt.Client) {
+	m.log.Info("connected to mqtt broker")
+
+	subs := map[string]mqtt.MessageHandler{
+		m.fanTopic("+", "set"):            m.handleFanSet,
+		m.fanTopic("+", "percentage/set"): m.handlePercentageSet,
+		m.fanTopic("+", "light/set"):      m.handleLightSet,
+	}
+
+	for topic, handler := range subs {
+		t := c.Subscribe(topic, 1, handler)
+		t.Wait()
+		if err := t.Error(); err != nil {
+			m.log.Warn("error subscribing", "topic", topic, "error", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.published = make(map[string]bool)
+	m.mu.Unlock()
+
+	m.refresh()
+	m.publishHubDiscovery()
+
+	if env, last, _ := m.poller.reading(); !last.IsZero() {
+		m.publishSensors(env)
+	}
+
+	m.publish(m.availabilityTopic(), true, "online")
+}
+
+// refresh publishes discovery payloads and state for the configured fans
+// and removes the entities of fans which are no longer configured.
+func (m *mqttBridge) refresh() {
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, f := range m.srv.fanList() {
+		id := f.config().ID
+		current[id] = true
+
+		m.publishFanDiscovery(f)
+		m.publishFan(f)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id := range m.published {
+		if !current[id] {
+			// An empty retained config removes the entity.
+			m.publish(m.discoveryTopic("fan", id), true, "")
+			m.publish(m.discoveryTopic("light", id+"_light"), true, "")
+		}
+	}
+
+	m.published = current
+}
+
+func (m *mqttBridge) discoveryTopic(component, objectID string) string {
+	return m.discoveryPrefix + "/" + component + "/hkrm4_" + objectID + "/config"
+}
+
+func (m *mqttBridge) hubDevice() haDevice {
+	cfg := m.srv.config()
+	model := m.srv.bl.Info().Name
+
+	return haDevice{
+		Identifiers:  []string{"hkrm4_" + cfg.MAC},
+		Name:         model,
+		Manufacturer: "BroadLink",
+		Model:        model,
+	}
+}
+
+func (m *mqttBridge) publishFanDiscovery(f *fan) {
+	cfg := f.config()
+
+	dev := haDevice{
+		Identifiers:  []string{"hkrm4_" + cfg.ID},
+		Name:         cfg.Name,
+		Manufacturer: cfg.Manufacturer,
+		Model:        cfg.Model,
+		SWVersion:    cfg.FirmwareRevision,
+		ViaDevice:    m.hubDevice().Identifiers[0],
+	}
+
+	fan := haEntity{
+		Name:                   cfg.Name,
+		UniqueID:               "hkrm4_" + cfg.ID,
+		Device:                 dev,
+		AvailabilityTopic:      m.availabilityTopic(),
+		StateTopic:             m.fanTopic(cfg.ID, "state"),
+		CommandTopic:           m.fanTopic(cfg.ID, "set"),
+		PercentageStateTopic:   m.fanTopic(cfg.ID, "percentage"),
+		PercentageCommandTopic: m.fanTopic(cfg.ID, "percentage/set"),
+		SpeedRangeMin:          1,
+		SpeedRangeMax:          100,
+	}
+
+	light := haEntity{
+		Name:              cfg.Name + " Light",
+		UniqueID:          "hkrm4_" + cfg.ID + "_light",
+		Device:            dev,
+		AvailabilityTopic: m.availabilityTopic(),
+		StateTopic:        m.fanTopic(cfg.ID, "light"),
+		CommandTopic:      m.fanTopic(cfg.ID, "light/set"),
+	}
+
+	m.publishJSON(m.discoveryTopic("fan", cfg.ID), fan)
+	m.publishJSON(m.discoveryTopic("light", cfg.ID+"_light"), light)
+}
+
+func (m *mqttBridge) publishHubDiscovery() {
+	dev := m.hubDevice()
+
+	temp := haEntity{
+		Name:              dev.Name + " Temperature",
+		UniqueID:          dev.Identifiers[0] + "_temperature",
+		Device:            dev,
+		AvailabilityTopic: m.availabilityTopic(),
+		StateTopic:        m.hubTopic("temperature"),
+		DeviceClass:       "temperature",
+		StateClass:        "measurement",
+		UnitOfMeasurement: "°C",
+	}
+
+	hum := haEntity{
+		Name:              dev.Name + " Humidity",
+		UniqueID:          dev.Identifiers[0] + "_humidity",
+		Device:            dev,
+		AvailabilityTopic: m.availabilityTopic(),
+		StateTopic:        m.hubTopic("humidity"),
+		DeviceClass:       "humidity",
+		StateClass:        "measurement",
+		UnitOfMeasurement: "%",
+	}
+
+	m.publishJSON(m.discoveryTopic("sensor", defaultDeviceID+"_temperature"), temp)
+	m.publishJSON(m.discoveryTopic("sensor", defaultDeviceID+"_humidity"), hum)
+}
+
+func (m *mqttBridge) publishJSON(topic string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		m.log.Error("error encoding", "topic", topic, "error", err)
+		return
+	}
+
+	m.publish(topic, true, b)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+
+	return "OFF"
+}
+
+// publishFan publishes the fan's believed state to its retained topics.
+func (m *mqttBridge) publishFan(f *fan) {
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+
+	id := f.config().ID
+	st := f.state()
+
+	m.publish(m.fanTopic(id, "state"), true, onOff(st.On))
+	m.publish(m.fanTopic(id, "percentage"), true, strconv.Itoa(int(st.Speed)))
+	m.publish(m.fanTopic(id, "light"), true, onOff(st.Light))
+}
+
+func (m *mqttBridge) publishSensors(env broadlink.Environment) {
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+
+	m.publish(m.hubTopic("temperature"), true, strconv.FormatFloat(env.Temperature, 'f', 2, 64))
+	m.publish(m.hubTopic("humidity"), true, strconv.FormatFloat(env.Humidity, 'f', 2, 64))
+}
+
+// commandFan returns the fan addressed by a command topic of the form
+// <prefix>/fan/<id>/...
+func (m *mqttBridge) commandFan(topic string) (*fan, error) {
+	rest := strings.TrimPrefix(topic, m.prefix+"/fan/")
+	id := strings.SplitN(rest, "/", 2)[0]
+
+	f := m.srv.fan(id)
+	if f == nil {
+		return nil, fmt.Errorf("no such fan %q", id)
+	}
+
+	return f, nil
+}
+
+func parseOnOff(payload []byte) (bool, error) {
+	switch strings.ToUpper(strings.TrimSpace(string(payload))) {
+	case "ON":
+		return true, nil
+	case "OFF":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid payload %q, expected ON or OFF", payload)
+	}
+}
+
+func (m *mqttBridge) handle(msg mqtt.Message, fn func(f *fan) error) {
+	m.log.Debug("mqtt command", "topic", msg.Topic(), "payload", string(msg.Payload()))
+
+	f, err := m.commandFan(msg.Topic())
+	if err == nil {
+		err = fn(f)
+	}
+
+	if err != nil {
+		m.log.Error("error handling mqtt command", "topic", msg.Topic(), "error", err)
+	}
+}
+
+func (m *mqttBridge) handleFanSet(_ mqtt.Client, msg mqtt.Message) {
+	m.handle(msg, func(f *fan) error {
+		on, err := parseOnOff(msg.Payload())
+		if err != nil {
+			return err
+		}
+
+		return f.set(&on, nil, nil)
+	})
+}
+
+func (m *mqttBridge) handlePercentageSet(_ mqtt.Client, msg mqtt.Message) {
+	m.handle(msg, func(f *fan) error {
+		speed, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+		if err != nil || speed < 0 || speed > 100 {
+			return fmt.Errorf("invalid percentage %q", msg.Payload())
+		}
+
+		// Like Home Assistant, treat 0% as off, keeping the last speed
+		// for when the fan is turned back on.
+		if speed == 0 {
+			off := false
+			return f.set(&off, nil, nil)
+		}
+
+		return f.set(nil, &speed, nil)
+	})
+}
+
+func (m *mqttBridge) handleLightSet(_ mqtt.Client, msg mqtt.Message) {
+	m.handle(msg, func(f *fan) error {
+		on, err := parseOnOff(msg.Payload())
+		if err != nil {
+			return err
+		}
+
+		return f.set(nil, nil, &on)
+	})
+}
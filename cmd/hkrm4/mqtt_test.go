@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	"github.com/brutella/hc"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+const testMQTTConfig = `
+ip: 127.0.0.1
+mac: aa:bb:cc:dd:ee:ff
+mqtt: tcp://%s
+data: %s
+fans:
+  - id: bed
+    name: Bedroom Fan
+    commands:
+      lightToggle: hex:260001ff
+      speed: [hex:26000100, hex:26000101, hex:26000102]
+`
+
+// fakeHub stands in for a Broadlink hub, recording the codes sent through
+// it as hex. Learning returns learned.
+type fakeHub struct {
+	mu      sync.Mutex
+	sent    []string
+	learned []byte
+}
+
+func (h *fakeHub) Info() broadlink.DeviceInfo {
+	return broadlink.DeviceInfo{Name: "RM4 mini", IR: true}
+}
+
+func (h *fakeHub) SetMinInterval(interval time.Duration) {}
+
+func (h *fakeHub) SendDataGap(data []byte, gap time.Duration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sent = append(h.sent, hex.EncodeToString(data))
+	return nil
+}
+
+func (h *fakeHub) CheckSensors() (float64, float64, error) {
+	return 21.5, 40, nil
+}
+
+func (h *fakeHub) Learn() ([]byte, error) {
+	if h.learned == nil {
+		return nil, fmt.Errorf("not supported")
+	}
+
+	return h.learned, nil
+}
+
+func (h *fakeHub) LearnRF() ([]byte, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (h *fakeHub) last() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.sent) == 0 {
+		return ""
+	}
+
+	return h.sent[len(h.sent)-1]
+}
+
+// startBroker runs an embedded MQTT broker for the test and returns its
+// address.
+func startBroker(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	broker := mqttserver.New(&mqttserver.Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+
+	err = broker.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = broker.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: addr}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { broker.Close() })
+
+	return addr
+}
+
+// observer is a second MQTT client which records the last payload seen on
+// each topic.
+type observer struct {
+	client mqtt.Client
+
+	mu       sync.Mutex
+	payloads map[string][]byte
+}
+
+func newObserver(t *testing.T, addr string) *observer {
+	o := &observer{payloads: make(map[string][]byte)}
+
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("observer")
+	o.client = mqtt.NewClient(opts)
+
+	tok := o.client.Connect()
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("error connecting observer: %v", tok.Error())
+	}
+	t.Cleanup(func() { o.client.Disconnect(0) })
+
+	filters := map[string]byte{"hkrm4/#": 1, "homeassistant/#": 1}
+	tok = o.client.SubscribeMultiple(filters, func(_ mqtt.Client, msg mqtt.Message) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		o.payloads[msg.Topic()] = msg.Payload()
+	})
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("error subscribing observer: %v", tok.Error())
+	}
+
+	return o
+}
+
+func (o *observer) payload(topic string) ([]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	p, ok := o.payloads[topic]
+	return p, ok
+}
+
+// waitFor waits for want to be the last payload on topic.
+func (o *observer) waitFor(t *testing.T, topic, want string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p, ok := o.payload(topic); ok && string(p) == want {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p, _ := o.payload(topic)
+	t.Fatalf("%s is %q, want %q", topic, p, want)
+}
+
+// entity waits for the discovery payload on topic and decodes it.
+func (o *observer) entity(t *testing.T, topic string) haEntity {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p, ok := o.payload(topic); ok {
+			var e haEntity
+			err := json.Unmarshal(p, &e)
+			if err != nil {
+				t.Fatalf("invalid discovery payload on %s: %v", topic, err)
+			}
+
+			return e
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("no discovery payload on %s", topic)
+	return haEntity{}
+}
+
+func (o *observer) publish(t *testing.T, topic, payload string) {
+	t.Helper()
+
+	tok := o.client.Publish(topic, 1, false, payload)
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("error publishing to %s: %v", topic, tok.Error())
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	addr := startBroker(t)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(path, []byte(fmt.Sprintf(testMQTTConfig, addr, dir)), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path, overrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hub := &fakeHub{}
+
+	srv, err := newServer(hub, hc.Config{StoragePath: dir}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = srv.apply(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poller := newSensorPoller(log, hubSensors(hub))
+	bridge := newMQTTBridge(cfg, srv, poller, log)
+	bridge.connect()
+	t.Cleanup(bridge.close)
+
+	obs := newObserver(t, addr)
+
+	// Retained state is delivered to a client subscribing after it was
+	// published.
+	obs.waitFor(t, "hkrm4/status", "online")
+	obs.waitFor(t, "hkrm4/fan/bed/state", "OFF")
+	obs.waitFor(t, "hkrm4/fan/bed/percentage", "0")
+	obs.waitFor(t, "hkrm4/fan/bed/light", "OFF")
+
+	fan := obs.entity(t, "homeassistant/fan/hkrm4_bed/config")
+	if fan.UniqueID != "hkrm4_bed" || fan.Name != "Bedroom Fan" {
+		t.Errorf("fan entity is %q named %q", fan.UniqueID, fan.Name)
+	}
+	if fan.CommandTopic != "hkrm4/fan/bed/set" || fan.PercentageCommandTopic != "hkrm4/fan/bed/percentage/set" {
+		t.Errorf("fan command topics are %q and %q", fan.CommandTopic, fan.PercentageCommandTopic)
+	}
+	if fan.AvailabilityTopic != "hkrm4/status" {
+		t.Errorf("fan availability topic is %q", fan.AvailabilityTopic)
+	}
+	if fan.Device.ViaDevice != "hkrm4_aa:bb:cc:dd:ee:ff" {
+		t.Errorf("fan is via %q", fan.Device.ViaDevice)
+	}
+
+	light := obs.entity(t, "homeassistant/light/hkrm4_bed_light/config")
+	if light.CommandTopic != "hkrm4/fan/bed/light/set" || light.StateTopic != "hkrm4/fan/bed/light" {
+		t.Errorf("light topics are %q and %q", light.CommandTopic, light.StateTopic)
+	}
+
+	temp := obs.entity(t, "homeassistant/sensor/hkrm4_default_temperature/config")
+	if temp.DeviceClass != "temperature" || temp.StateTopic != "hkrm4/hub/default/temperature" {
+		t.Errorf("temperature sensor is %q on %q", temp.DeviceClass, temp.StateTopic)
+	}
+
+	// Commands go through fan.set, so they are sent to the hub and the
+	// new state is published.
+	obs.publish(t, "hkrm4/fan/bed/percentage/set", "100")
+	obs.waitFor(t, "hkrm4/fan/bed/state", "ON")
+	obs.waitFor(t, "hkrm4/fan/bed/percentage", "100")
+	if got := hub.last(); got != "26000102" {
+		t.Errorf("sent %q for 100%%, want the speed2 code", got)
+	}
+
+	// 0% turns the fan off but keeps its speed for when it is turned on.
+	obs.publish(t, "hkrm4/fan/bed/percentage/set", "0")
+	obs.waitFor(t, "hkrm4/fan/bed/state", "OFF")
+	obs.waitFor(t, "hkrm4/fan/bed/percentage", "100")
+	if got := hub.last(); got != "26000100" {
+		t.Errorf("sent %q for 0%%, want the speed0 code", got)
+	}
+
+	obs.publish(t, "hkrm4/fan/bed/set", "ON")
+	obs.waitFor(t, "hkrm4/fan/bed/state", "ON")
+	if got := hub.last(); got != "26000102" {
+		t.Errorf("sent %q for ON, want the speed2 code", got)
+	}
+
+	obs.publish(t, "hkrm4/fan/bed/light/set", "ON")
+	obs.waitFor(t, "hkrm4/fan/bed/light", "ON")
+	if got := hub.last(); got != "260001ff" {
+		t.Errorf("sent %q for the light, want the lightToggle code", got)
+	}
+}
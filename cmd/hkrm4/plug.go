@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const plugPollInterval = 30 * time.Second
+
+// plugInUseWatts is the draw above which a metering plug reports that
+// something is plugged in and running.
+const plugInUseWatts = 1.0
+
+var plugPowerMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "hkrm4",
+	Subsystem: "plug",
+	Name:      "power_watts",
+	Help:      "Power drawn through a metering smart plug.",
+}, []string{"id"})
+
+// plugConfig is a Broadlink SP1, SP2 or SP3 smart plug. Each plug is a
+// device of its own rather than something driven through the hub.
+type plugConfig struct {
+	ID   string `json:"id" yaml:"id" toml:"id"`
+	Name string `json:"name" yaml:"name" toml:"name"`
+
+	IP  net.IP `json:"ip" yaml:"ip" toml:"ip"`
+	MAC string `json:"mac" yaml:"mac" toml:"mac"`
+
+	// Type is required, since 0 is itself a model: the SP1.
+	Type *int `json:"type" yaml:"type" toml:"type"`
+
+	// Nightlight publishes the plug's nightlight as a light.
+	Nightlight bool `json:"nightlight,omitempty" yaml:"nightlight,omitempty" toml:"nightlight,omitempty"`
+}
+
+func (p *plugConfig) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("has no name")
+	}
+
+	if p.IP == nil {
+		return fmt.Errorf("has no ip")
+	}
+
+	_, err := net.ParseMAC(p.MAC)
+	if err != nil {
+		return err
+	}
+
+	if p.Type == nil {
+		return fmt.Errorf("has no type")
+	}
+
+	return nil
+}
+
+func (p *plugConfig) devType() int {
+	return *p.Type
+}
+
+func (p *plugConfig) key() string {
+	return p.ID
+}
+
+// sameDevice reports whether other addresses the same plug.
+func (p *plugConfig) sameDevice(other *plugConfig) bool {
+	return p.IP.Equal(other.IP) &&
+		p.MAC == other.MAC &&
+		p.devType() == other.devType()
+}
+
+// sameAccessory reports whether other would publish the same accessory.
+func (p *plugConfig) sameAccessory(other *plugConfig) bool {
+	return p.Name == other.Name &&
+		p.Nightlight == other.Nightlight
+}
+
+// plug is a smart plug published as a HomeKit outlet. It connects and polls
+// in the background, so an unreachable plug does not hold up the others.
+type plug struct {
+	id   uint64
+	dev  *remoteDevice
+	log  *slog.Logger
+	stop chan struct{}
+
+	mu         sync.Mutex
+	cfg        plugConfig
+	on         bool
+	nightlight bool
+	watts      float64
+	metering   bool
+
+	// Characteristics of the currently published accessory.
+	onChar         *characteristic.On
+	inUseChar      *characteristic.OutletInUse
+	nightlightChar *characteristic.On
+}
+
+func newPlug(id uint64, cfg plugConfig, log *slog.Logger) *plug {
+	dev := newRemoteDevice("plug", cfg.ID, cfg.IP, cfg.MAC, cfg.devType(), log)
+	dev.check = requirePower
+
+	p := &plug{
+		id:   id,
+		dev:  dev,
+		log:  log,
+		stop: make(chan struct{}),
+		cfg:  cfg,
+	}
+
+	go p.run()
+
+	return p
+}
+
+func (p *plug) config() plugConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.cfg
+}
+
+// update replaces the config of a plug at the same address.
+func (p *plug) update(cfg plugConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cfg = cfg
+}
+
+// close stops polling and drops the plug's metrics.
+func (p *plug) close() {
+	close(p.stop)
+	p.dev.close()
+
+	plugPowerMetric.DeleteLabelValues(p.config().ID)
+}
+
+func (p *plug) run() {
+	pollEvery(plugPollInterval, p.stop, p.poll)
+}
+
+func (p *plug) poll() {
+	bl, err := p.dev.get()
+	if err != nil {
+		p.log.Warn(err.Error())
+		return
+	}
+
+	cfg := p.config()
+
+	// The SP1 cannot report its state, so the believed state stands.
+	if cfg.devType() == 0 {
+		return
+	}
+
+	on, err := bl.CheckPower()
+	if err != nil {
+		p.log.Warn("error polling plug", "error", err)
+		return
+	}
+
+	nightlight := false
+	if cfg.Nightlight {
+		nightlight, err = bl.CheckNightlight()
+		if err != nil {
+			p.log.Warn("error polling plug", "error", err)
+			return
+		}
+	}
+
+	watts := 0.0
+	if bl.MeasuresEnergy() {
+		watts, err = bl.CheckEnergy()
+		if err != nil {
+			p.log.Warn("error polling plug", "error", err)
+			return
+		}
+
+		plugPowerMetric.WithLabelValues(cfg.ID).Set(watts)
+	}
+
+	p.log.Debug("polled plug", "on", on, "nightlight", nightlight, "watts", watts)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.on, p.nightlight, p.watts = on, nightlight, watts
+	p.metering = bl.MeasuresEnergy()
+	p.updateChars()
+}
+
+// inUse reports whether something is drawing power through the plug. Plugs
+// which cannot measure this report in use whenever they are on. p.mu must
+// be held.
+func (p *plug) inUse() bool {
+	if p.metering {
+		return p.on && p.watts >= plugInUseWatts
+	}
+
+	return p.on
+}
+
+// updateChars pushes the believed state to the published accessory. p.mu
+// must be held.
+func (p *plug) updateChars() {
+	if p.onChar == nil {
+		return
+	}
+
+	p.onChar.SetValue(p.on)
+	p.inUseChar.SetValue(p.inUse())
+
+	if p.nightlightChar != nil {
+		p.nightlightChar.SetValue(p.nightlight)
+	}
+}
+
+func (p *plug) setOn(on bool) error {
+	p.log.Debug("setting plug", "on", on)
+
+	bl, err := p.dev.get()
+	if err != nil {
+		return err
+	}
+
+	err = bl.SetPower(on)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.on = on
+	p.updateChars()
+
+	return nil
+}
+
+func (p *plug) setNightlight(on bool) error {
+	p.log.Debug("setting plug", "nightlight", on)
+
+	bl, err := p.dev.get()
+	if err != nil {
+		return err
+	}
+
+	err = bl.SetNightlight(on)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nightlight = on
+	p.updateChars()
+
+	return nil
+}
+
+// accessory builds a HomeKit outlet for the plug from its current config and
+// state.
+func (p *plug) accessory() *accessory.Accessory {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info := accessory.Info{
+		Name:         p.cfg.Name,
+		Manufacturer: "BroadLink",
+		Model:        "Smart Plug",
+		SerialNumber: p.cfg.MAC,
+		ID:           p.id,
+	}
+
+	acc := accessory.New(info, accessory.TypeOutlet)
+
+	outlet := service.NewOutlet()
+	outlet.On.SetValue(p.on)
+	outlet.On.OnValueRemoteUpdate(logError(p.log, p.setOn))
+	outlet.OutletInUse.SetValue(p.inUse())
+	acc.AddService(outlet.Service)
+
+	p.onChar = outlet.On
+	p.inUseChar = outlet.OutletInUse
+	p.nightlightChar = nil
+
+	if p.cfg.Nightlight {
+		light := service.NewLightbulb()
+		light.On.SetValue(p.nightlight)
+		light.On.OnValueRemoteUpdate(logError(p.log, p.setNightlight))
+		acc.AddService(light.Service)
+
+		p.nightlightChar = light.On
+	}
+
+	return acc
+}
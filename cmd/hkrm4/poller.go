@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+)
+
+const sensorPollInterval = time.Minute
+
+// sensorPoller reads a device's sensors in the background and passes each
+// reading on to its listeners. Hubs only fill in the temperature and
+// humidity of the reading.
+type sensorPoller struct {
+	log  *slog.Logger
+	read func() (broadlink.Environment, error)
+	stop chan struct{}
+
+	mu        sync.Mutex
+	env       broadlink.Environment
+	last      time.Time
+	err       error
+	listeners []func(broadlink.Environment)
+}
+
+func newSensorPoller(log *slog.Logger, read func() (broadlink.Environment, error)) *sensorPoller {
+	return &sensorPoller{
+		log:  log,
+		read: read,
+		stop: make(chan struct{}),
+	}
+}
+
+// pollEvery calls poll straight away and then every interval until stop is
+// closed.
+func pollEvery(interval time.Duration, stop <-chan struct{}, poll func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		poll()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// hubSensors reads the temperature and humidity sensors of a hub.
+func hubSensors(bl hub) func() (broadlink.Environment, error) {
+	return func() (broadlink.Environment, error) {
+		temp, hum, err := bl.CheckSensors()
+		return broadlink.Environment{Temperature: temp, Humidity: hum}, err
+	}
+}
+
+// subscribe registers fn to be called with every successful reading.
+func (p *sensorPoller) subscribe(fn func(broadlink.Environment)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.listeners = append(p.listeners, fn)
+}
+
+// reading returns the last successful reading, when it was taken and the
+// error from the most recent poll.
+func (p *sensorPoller) reading() (broadlink.Environment, time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.env, p.last, p.err
+}
+
+func (p *sensorPoller) poll() {
+	env, err := p.read()
+
+	p.mu.Lock()
+	p.err = err
+	if err != nil {
+		p.mu.Unlock()
+		p.log.Warn("error polling sensors", "error", err)
+		return
+	}
+
+	p.env, p.last = env, time.Now()
+	listeners := p.listeners
+	p.mu.Unlock()
+
+	p.log.Debug("polled sensors", "temperature", env.Temperature, "humidity", env.Humidity)
+
+	for _, fn := range listeners {
+		fn(env)
+	}
+}
+
+// run polls the sensors until close is called.
+func (p *sensorPoller) run() {
+	pollEvery(sensorPollInterval, p.stop, p.poll)
+}
+
+func (p *sensorPoller) close() {
+	close(p.stop)
+}
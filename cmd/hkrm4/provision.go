@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+)
+
+const provisionUsage = "usage: hkrm4 provision [-security mode] [-password pw | -password-file path] [-ip addr] <ssid>"
+
+// runProvisionCommand implements "hkrm4 provision", which puts a factory
+// reset device onto Wi-Fi without the vendor app, leaving it unlocked for
+// local control.
+func runProvisionCommand(args []string) {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	security := fs.String("security", "wpa2", "Wi-Fi security: none, wep, wpa1, wpa2 or wpa1/2.")
+	password := fs.String("password", "", "Wi-Fi password.")
+	passwordFile := fs.String("password-file", "", "Path of a file containing the Wi-Fi password.")
+	ip := fs.String("ip", "", "Address of the device - by default the join packet is broadcast.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), provisionUsage)
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Put the device in setup mode by holding reset until its light blinks quickly,")
+		fmt.Fprintln(fs.Output(), "then press reset again so it blinks slowly and offers its own access point.")
+		fmt.Fprintln(fs.Output(), "Join that access point and run this command.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ssid := fs.Arg(0)
+
+	mode, err := broadlink.ParseSecurity(*security)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *passwordFile != "" {
+		b, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			log.Fatalf("error reading password file: %v", err)
+		}
+
+		*password = strings.TrimSpace(string(b))
+	}
+
+	if *password == "" && mode != broadlink.SecurityNone {
+		log.Fatalf("a password is needed for %s security", *security)
+	}
+
+	if *ip == "" {
+		err = broadlink.Provision(ssid, *password, mode)
+	} else {
+		addr := net.ParseIP(*ip)
+		if addr == nil {
+			log.Fatalf("invalid ip address %q", *ip)
+		}
+
+		err = broadlink.ProvisionAt(addr, ssid, *password, mode)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("sent the details for %q, the device should now leave setup mode and join the network\n", ssid)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+)
+
+const defaultReadyMaxAge = 3 * sensorPollInterval
+
+// readiness decides whether hkrm4 is ready: the hub must be authenticated
+// and its sensors read successfully within maxAge.
+type readiness struct {
+	bl     *broadlink.Device
+	poller *sensorPoller
+	maxAge time.Duration
+}
+
+func newReadiness(bl *broadlink.Device, poller *sensorPoller, maxAge time.Duration) *readiness {
+	if maxAge <= 0 {
+		maxAge = defaultReadyMaxAge
+	}
+
+	return &readiness{
+		bl:     bl,
+		poller: poller,
+		maxAge: maxAge,
+	}
+}
+
+// check returns why hkrm4 is not ready, or nil if it is.
+func (r *readiness) check() error {
+	if !r.bl.Authenticated() {
+		return errors.New("the hub is not authenticated")
+	}
+
+	_, last, err := r.poller.reading()
+	if last.IsZero() {
+		if err != nil {
+			return fmt.Errorf("the hub's sensors have not been read: %v", err)
+		}
+
+		return errors.New("the hub's sensors have not been read yet")
+	}
+
+	age := time.Since(last)
+	if age > r.maxAge && err != nil {
+		return fmt.Errorf("the hub's sensors were last read %v ago: %v", age.Round(time.Second), err)
+	}
+
+	if age > r.maxAge {
+		return fmt.Errorf("the hub's sensors were last read %v ago", age.Round(time.Second))
+	}
+
+	return nil
+}
+
+// register serves /healthz, which reports that the process is alive, and
+// /readyz, which reports whether hkrm4 is ready.
+func (r *readiness) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		err := r.check()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
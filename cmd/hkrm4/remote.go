@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+)
+
+// remoteDevice is a Broadlink device other than the hub, such as a plug or
+// sensor. It is connected on first use, so that one which is unreachable
+// does not hold up the rest.
+type remoteDevice struct {
+	// id is the accessory's ID and desc names the device in errors, e.g.
+	// `plug "lamp"`.
+	id      string
+	desc    string
+	ip      net.IP
+	mac     string
+	devType int
+	log     *slog.Logger
+
+	// product is what a device whose type needs probing must turn out to
+	// be.
+	product broadlink.Product
+
+	// check, if set, refuses a device which cannot do what is needed of
+	// it.
+	check func(broadlink.DeviceInfo) error
+
+	mu     sync.Mutex
+	bl     *broadlink.Device
+	closed bool
+}
+
+// deviceOptions are passed to every Broadlink device hkrm4 connects to.
+var deviceOptions []broadlink.Option
+
+// newRemoteDevice describes the device of the accessory with the given kind
+// and ID, e.g. "plug" and "lamp". The device logs through log.
+func newRemoteDevice(kind, id string, ip net.IP, mac string, devType int, log *slog.Logger) *remoteDevice {
+	return &remoteDevice{
+		id:      id,
+		desc:    fmt.Sprintf("%s %q", kind, id),
+		ip:      ip,
+		mac:     mac,
+		devType: devType,
+		log:     log,
+	}
+}
+
+// get returns the device, connecting to it if need be.
+func (r *remoteDevice) get() (*broadlink.Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, fmt.Errorf("%s has been removed", r.desc)
+	}
+
+	if r.bl != nil {
+		return r.bl, nil
+	}
+
+	mac, err := net.ParseMAC(r.mac)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append([]broadlink.Option{broadlink.WithLogger(r.log), broadlink.WithObserver(deviceMetrics(r.id))}, deviceOptions...)
+	bl, err := broadlink.NewDevice(r.ip, mac, r.devType, opts...)
+	if err != nil {
+		return nil, connectError(r.desc, err)
+	}
+
+	if r.product != broadlink.ProductUnknown && bl.NeedsProbe() {
+		product, err := bl.Probe()
+		if err != nil {
+			bl.Close()
+			return nil, fmt.Errorf("error probing %s: %v", r.desc, err)
+		}
+
+		if product != r.product {
+			bl.Close()
+			return nil, fmt.Errorf("%s is a %v, not a %v", r.desc, product, r.product)
+		}
+	}
+
+	if r.check != nil {
+		err = r.check(bl.Info())
+		if err != nil {
+			bl.Close()
+			return nil, fmt.Errorf("error connecting to %s: %v", r.desc, err)
+		}
+	}
+
+	r.bl = bl
+	return bl, nil
+}
+
+// close disconnects from the device for good.
+func (r *remoteDevice) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.bl != nil {
+		r.bl.Close()
+		r.bl = nil
+	}
+
+	r.closed = true
+}
+
+// connectError describes a failure to connect to a device, explaining what
+// to do about a locked one.
+func connectError(desc string, err error) error {
+	if err == broadlink.ErrLocked {
+		return fmt.Errorf("%s is locked against local control: turn off \"Lock device\" in the device's properties in the Broadlink app, "+
+			"or factory reset it and set it up again with \"hkrm4 provision\"", desc)
+	}
+
+	return fmt.Errorf("error connecting to %s: %v", desc, err)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// readyPollInterval is how often readiness is checked before systemd has
+// been told hkrm4 is ready, when there is no watchdog to set the pace.
+const readyPollInterval = 5 * time.Second
+
+// sdNotify sends state to systemd's notification socket. It does nothing
+// unless hkrm4 runs as a systemd service of Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	// A leading @ names a socket in the abstract namespace.
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the watchdog timeout systemd set for hkrm4, or
+// 0 if there is none.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd tells systemd once hkrm4 is ready and, if the service has
+// a watchdog, pets it for as long as hkrm4 stays ready, so that systemd
+// restarts hkrm4 when it loses the hub.
+func (r *readiness) notifySystemd(log *slog.Logger) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	watchdog := sdWatchdogInterval()
+
+	interval := watchdog / 2
+	if interval == 0 {
+		interval = readyPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := false
+	status := ""
+	for {
+		state := ""
+
+		err := r.check()
+		if err == nil && !ready {
+			state = "READY=1\n"
+			ready = true
+		}
+
+		if err == nil && watchdog > 0 {
+			state += "WATCHDOG=1\n"
+		}
+
+		s := "ready"
+		if err != nil {
+			s = "not ready: " + err.Error()
+		}
+
+		if s != status {
+			state += "STATUS=" + s + "\n"
+			status = s
+		}
+
+		if state != "" {
+			err = sdNotify(state)
+			if err != nil {
+				log.Warn("error notifying systemd", "error", err)
+			}
+		}
+
+		if ready && watchdog == 0 {
+			return
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/service"
+)
+
+// server owns the HomeKit transport and the accessories published through
+// it. When the set of accessories changes the transport is restarted; hc
+// stores the pairings in the data directory and bumps the configuration
+// number itself, so controllers pick up the new accessories without
+// re-pairing.
+type server struct {
+	bl       *serialHub
+	hcConfig hc.Config
+	log      *slog.Logger
+	ids      *accessoryIDs
+	levels   *fanLevels
+	queue    *hubQueue
+
+	mu           sync.Mutex
+	cfg          *config
+	fans         map[string]*fan
+	macros       map[string]*macro
+	plugs        map[string]*plug
+	strips       map[string]*strip
+	sensors      map[string]*a1Sensor
+	thermostats  map[string]*thermostat
+	curtains     map[string]*curtain
+	fanListeners []func(*fan)
+	transport    hc.Transport
+	stopped      chan struct{}
+
+	// Sensor services of the currently published bridge.
+	temperature *service.TemperatureSensor
+	humidity    *service.HumiditySensor
+}
+
+// hub is the part of *broadlink.Device used through the server, so that
+// tests can stand in for the hub.
+type hub interface {
+	Info() broadlink.DeviceInfo
+	SetMinInterval(interval time.Duration)
+	SendDataGap(data []byte, gap time.Duration) error
+	CheckSensors() (float64, float64, error)
+	Learn() ([]byte, error)
+	LearnRF() ([]byte, error)
+}
+
+// serialHub lets one user at a time transmit through the hub, so that the
+// steps of a macro are never interleaved with other sends. Sends and
+// learning through it wait their turn.
+type serialHub struct {
+	hub
+	mu sync.Mutex
+}
+
+// exclusive runs fn holding the hub. fn sends through tx, which does not
+// wait for the hub again.
+func (h *serialHub) exclusive(fn func(tx hub) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return fn(h.hub)
+}
+
+func (h *serialHub) SendDataGap(data []byte, gap time.Duration) error {
+	return h.exclusive(func(tx hub) error {
+		return tx.SendDataGap(data, gap)
+	})
+}
+
+func (h *serialHub) Learn() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.hub.Learn()
+}
+
+func (h *serialHub) LearnRF() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.hub.LearnRF()
+}
+
+func newServer(bl hub, hcConfig hc.Config, log *slog.Logger) (*server, error) {
+	ids, err := loadAccessoryIDs(hcConfig.StoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading accessory ids: %v", err)
+	}
+
+	levels, err := loadFanLevels(hcConfig.StoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading fan levels: %v", err)
+	}
+
+	return &server{
+		bl:       &serialHub{hub: bl},
+		hcConfig: hcConfig,
+		log:      log,
+		ids:      ids,
+		levels:   levels,
+		queue:    newHubQueue(),
+		fans:     make(map[string]*fan),
+		macros:   make(map[string]*macro),
+		plugs:    make(map[string]*plug),
+		strips:   make(map[string]*strip),
+		sensors:  make(map[string]*a1Sensor),
+
+		thermostats: make(map[string]*thermostat),
+		curtains:    make(map[string]*curtain),
+	}, nil
+}
+
+// apply updates the fans and macros to match cfg and reports whether the
+// set of published accessories has changed.
+func (s *server) apply(cfg *config) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := s.cfg == nil
+
+	s.bl.SetMinInterval(time.Duration(cfg.MinIntervalMs) * time.Millisecond)
+
+	fansChanged, err := s.applyFans(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	macrosChanged, err := s.applyMacros(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	plugsChanged, err := applyDevices(s, "plug", cfg.Plugs, s.plugs, newPlug)
+	if err != nil {
+		return false, err
+	}
+
+	stripsChanged, err := applyDevices(s, "strip", cfg.Strips, s.strips, newStrip)
+	if err != nil {
+		return false, err
+	}
+
+	sensorsChanged, err := applyDevices(s, "sensor", cfg.Sensors, s.sensors, newA1Sensor)
+	if err != nil {
+		return false, err
+	}
+
+	thermostatsChanged, err := applyDevices(s, "thermostat", cfg.Thermostats, s.thermostats, newThermostat)
+	if err != nil {
+		return false, err
+	}
+
+	curtainsChanged, err := applyDevices(s, "curtain", cfg.Curtains, s.curtains, newCurtain)
+	if err != nil {
+		return false, err
+	}
+
+	s.cfg = cfg
+
+	return changed || fansChanged || macrosChanged || plugsChanged || stripsChanged ||
+		sensorsChanged || thermostatsChanged || curtainsChanged, nil
+}
+
+func (s *server) applyFans(cfg *config) (bool, error) {
+	changed := false
+
+	current := make(map[string]bool)
+	for _, fc := range cfg.Fans {
+		current[fc.ID] = true
+
+		f, ok := s.fans[fc.ID]
+		if !ok {
+			id, err := s.ids.get("fan/" + fc.ID)
+			if err != nil {
+				return false, fmt.Errorf("error allocating accessory id for fan %q: %v", fc.ID, err)
+			}
+
+			s.log.Info("adding fan", "accessory", fc.ID, "id", id)
+			s.fans[fc.ID] = newFan(s.bl, id, fc, s.levels, s.fanChanged, s.log.With("accessory", fc.ID))
+			changed = true
+			continue
+		}
+
+		cur := f.config()
+		if !cur.sameAccessory(&fc) {
+			changed = true
+		}
+
+		f.update(fc)
+	}
+
+	for id, f := range s.fans {
+		if !current[id] {
+			s.log.Info("removing fan", "accessory", id)
+			f.remove()
+			delete(s.fans, id)
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+func (s *server) applyMacros(cfg *config) (bool, error) {
+	changed := false
+
+	current := make(map[string]bool)
+	for _, mc := range cfg.Macros {
+		current[mc.ID] = true
+
+		m, ok := s.macros[mc.ID]
+		if !ok {
+			id, err := s.ids.get("macro/" + mc.ID)
+			if err != nil {
+				return false, fmt.Errorf("error allocating accessory id for macro %q: %v", mc.ID, err)
+			}
+
+			s.log.Info("adding macro", "accessory", mc.ID, "id", id)
+			s.macros[mc.ID] = newMacro(s, id, mc, s.log.With("accessory", mc.ID))
+			changed = true
+			continue
+		}
+
+		if m.config().Name != mc.Name {
+			changed = true
+		}
+
+		m.update(mc)
+	}
+
+	for id := range s.macros {
+		if !current[id] {
+			s.log.Info("removing macro", "accessory", id)
+			delete(s.macros, id)
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// deviceConfig is the config of a device which hkrm4 connects to on its
+// own, such as a plug or a sensor, rather than sending codes through the
+// hub.
+type deviceConfig[C any] interface {
+	*C
+	key() string
+	sameDevice(other *C) bool
+	sameAccessory(other *C) bool
+}
+
+// device is an accessory built around a deviceConfig.
+type device[C any] interface {
+	config() C
+	update(cfg C)
+	close()
+}
+
+// applyDevices updates devs to match cfgs, adding, moving and removing
+// devices of the given kind, and reports whether the set of published
+// accessories has changed.
+func applyDevices[C any, P deviceConfig[C], D device[C]](s *server, kind string, cfgs []C, devs map[string]D, create func(uint64, C, *slog.Logger) D) (bool, error) {
+	changed := false
+
+	current := make(map[string]bool)
+	for _, dc := range cfgs {
+		key := P(&dc).key()
+		current[key] = true
+
+		d, ok := devs[key]
+		if ok {
+			cur := d.config()
+			if !P(&cur).sameAccessory(&dc) {
+				changed = true
+			}
+
+			if P(&cur).sameDevice(&dc) {
+				d.update(dc)
+				continue
+			}
+
+			// The device has moved, so reconnect under the same accessory
+			// ID and rebuild the accessory around the new device.
+			d.close()
+			changed = true
+		}
+
+		id, err := s.ids.get(kind + "/" + key)
+		if err != nil {
+			return false, fmt.Errorf("error allocating accessory id for %s %q: %v", kind, key, err)
+		}
+
+		if !ok {
+			s.log.Info("adding "+kind, "accessory", key, "id", id)
+			changed = true
+		}
+
+		devs[key] = create(id, dc, s.log.With("accessory", key))
+	}
+
+	for key, d := range devs {
+		if !current[key] {
+			s.log.Info("removing "+kind, "accessory", key)
+			d.close()
+			delete(devs, key)
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// reload applies cfg, restarting the transport if required.
+func (s *server) reload(cfg *config) error {
+	s.mu.Lock()
+	if s.cfg.needsRestart(cfg) {
+		s.log.Warn("device or server settings changed, restart hkrm4 to apply them")
+	}
+	s.mu.Unlock()
+
+	changed, err := s.apply(cfg)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		s.log.Info("config reloaded")
+		return nil
+	}
+
+	s.log.Info("config reloaded, accessories changed, restarting transport")
+
+	return s.restart()
+}
+
+// accessories builds a fresh accessory tree. hc assigns service and
+// characteristic IDs when an accessory is added to a transport and never
+// resets them, so accessories cannot be reused across transports.
+func (s *server) accessories() (*accessory.Accessory, []*accessory.Accessory) {
+	model := s.bl.Info().Name
+
+	info := accessory.Info{
+		Name:             model,
+		Manufacturer:     "BroadLink",
+		Model:            model,
+		FirmwareRevision: "N/A",
+		SerialNumber:     "N/A",
+		ID:               bridgeAccessoryID,
+	}
+	bridge := accessory.NewBridge(info)
+
+	s.temperature, s.humidity = s.sensorServices()
+	bridge.AddService(s.temperature.Service)
+	bridge.AddService(s.humidity.Service)
+
+	var accs []*accessory.Accessory
+	for _, fc := range s.cfg.Fans {
+		accs = append(accs, countWrites(fc.ID, s.fans[fc.ID].accessory()))
+	}
+
+	for _, mc := range s.cfg.Macros {
+		accs = append(accs, countWrites(mc.ID, s.macros[mc.ID].accessory()))
+	}
+
+	for _, pc := range s.cfg.Plugs {
+		accs = append(accs, countWrites(pc.ID, s.plugs[pc.ID].accessory()))
+	}
+
+	for _, sc := range s.cfg.Strips {
+		accs = append(accs, countWrites(sc.ID, s.strips[sc.ID].accessory()))
+	}
+
+	for _, ac := range s.cfg.Sensors {
+		accs = append(accs, countWrites(ac.ID, s.sensors[ac.ID].accessory()))
+	}
+
+	for _, tc := range s.cfg.Thermostats {
+		accs = append(accs, countWrites(tc.ID, s.thermostats[tc.ID].accessory()))
+	}
+
+	for _, cc := range s.cfg.Curtains {
+		accs = append(accs, countWrites(cc.ID, s.curtains[cc.ID].accessory()))
+	}
+
+	return bridge.Accessory, accs
+}
+
+func (s *server) sensorServices() (*service.TemperatureSensor, *service.HumiditySensor) {
+	temperature := service.NewTemperatureSensor()
+	temperature.CurrentTemperature.Float.OnValueRemoteGet(func() float64 {
+		temp, _, err := s.bl.CheckSensors()
+		if err != nil {
+			s.log.Warn("error reading temperature", "error", err)
+		}
+
+		s.log.Debug("read temperature", "temperature", temp)
+
+		return temp
+	})
+
+	humidity := service.NewHumiditySensor()
+	humidity.CurrentRelativeHumidity.Float.OnValueRemoteGet(func() float64 {
+		_, hum, err := s.bl.CheckSensors()
+		if err != nil {
+			s.log.Warn("error reading humidity", "error", err)
+		}
+
+		s.log.Debug("read humidity", "humidity", hum)
+
+		return hum
+	})
+
+	return temperature, humidity
+}
+
+// start creates and starts a transport for the current accessories.
+func (s *server) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bridge, accs := s.accessories()
+
+	transport, err := hc.NewIPTransport(s.hcConfig, bridge, accs...)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		transport.Start()
+		close(stopped)
+	}()
+
+	s.transport = transport
+	s.stopped = stopped
+
+	return nil
+}
+
+// stop stops the running transport and waits for it to exit.
+func (s *server) stop() {
+	s.mu.Lock()
+	transport, stopped := s.transport, s.stopped
+	s.transport, s.stopped = nil, nil
+	s.mu.Unlock()
+
+	if transport == nil {
+		return
+	}
+
+	<-transport.Stop()
+	<-stopped
+}
+
+func (s *server) restart() error {
+	s.stop()
+	return s.start()
+}
+
+// shutdown stops the transport, so controllers see the bridge go away, then
+// sends fan changes still waiting out their debounce, runs queued macros
+// until ctx is done and closes the accessories' devices.
+func (s *server) shutdown(ctx context.Context) {
+	s.stop()
+
+	for _, f := range s.fanList() {
+		err := f.drain(ctx)
+		if err != nil {
+			s.log.Warn("abandoning fan update", "accessory", f.config().ID, "error", err)
+		}
+	}
+
+	err := s.queue.close(ctx)
+	if err != nil {
+		s.log.Warn("abandoning queued macros", "error", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.plugs {
+		p.close()
+	}
+	for _, st := range s.strips {
+		st.close()
+	}
+	for _, a := range s.sensors {
+		a.close()
+	}
+	for _, t := range s.thermostats {
+		t.close()
+	}
+	for _, c := range s.curtains {
+		c.close()
+	}
+}
+
+// fan returns the fan with the given config ID, or nil.
+func (s *server) fan(id string) *fan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.fans[id]
+}
+
+// fanList returns the fans in config order.
+func (s *server) fanList() []*fan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var fans []*fan
+	for _, fc := range s.cfg.Fans {
+		fans = append(fans, s.fans[fc.ID])
+	}
+
+	return fans
+}
+
+// macro returns the macro with the given config ID, or nil.
+func (s *server) macro(id string) *macro {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.macros[id]
+}
+
+// macroList returns the macros in config order.
+func (s *server) macroList() []*macro {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var macros []*macro
+	for _, mc := range s.cfg.Macros {
+		macros = append(macros, s.macros[mc.ID])
+	}
+
+	return macros
+}
+
+// config returns the config currently applied.
+func (s *server) config() *config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cfg
+}
+
+// onFanChange registers fn to be called whenever a fan's state changes.
+func (s *server) onFanChange(fn func(*fan)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fanListeners = append(s.fanListeners, fn)
+}
+
+func (s *server) fanChanged(f *fan) {
+	s.mu.Lock()
+	listeners := s.fanListeners
+	s.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(f)
+	}
+}
+
+// updateSensors pushes a sensor reading to HomeKit.
+func (s *server) updateSensors(env broadlink.Environment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.temperature != nil {
+		s.temperature.CurrentTemperature.SetValue(env.Temperature)
+		s.humidity.CurrentRelativeHumidity.SetValue(env.Humidity)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "HKRM4_"
+
+// settingNames lists the settings which can be given in the config file, as
+// HKRM4_* environment variables or as flags. Environment variables take
+// precedence over the config file and flags take precedence over both.
+var settingNames = []string{
+	"ip",
+	"mac",
+	"type",
+	"pin",
+	"pin-file",
+	"port",
+	"data",
+	"metrics",
+	"api",
+	"api-token",
+	"api-token-file",
+	"mqtt",
+	"mqtt-username",
+	"mqtt-password",
+	"mqtt-password-file",
+	"mqtt-prefix",
+	"mqtt-discovery-prefix",
+	"min-interval-ms",
+	"device-models-file",
+	"local-addr",
+	"ready-max-age-seconds",
+	"verbose",
+	"log-level",
+	"log-format",
+}
+
+// secretFiles maps each secret setting to the setting naming a file to read
+// it from. Within one layer the file wins; a higher layer setting either one
+// replaces both from lower layers.
+var secretFiles = map[string]string{
+	"pin":           "pin-file",
+	"api-token":     "api-token-file",
+	"mqtt-password": "mqtt-password-file",
+}
+
+// overrides holds settings given outside of the config file, keyed by
+// setting name.
+type overrides map[string]string
+
+// envName returns the environment variable for a setting, e.g. HKRM4_PIN_FILE
+// for pin-file.
+func envName(setting string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// collectOverrides gathers settings from the environment and then from
+// any flags set on the command line.
+func collectOverrides(fs *flag.FlagSet) overrides {
+	env := make(overrides)
+	for _, name := range settingNames {
+		if v, ok := os.LookupEnv(envName(name)); ok {
+			env[name] = v
+		}
+	}
+
+	flags := make(overrides)
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range settingNames {
+			if f.Name == name {
+				flags[name] = f.Value.String()
+			}
+		}
+	})
+
+	o := make(overrides)
+	o.merge(env)
+	o.merge(flags)
+
+	return o
+}
+
+// merge overlays a higher layer of settings onto o. A secret or its file set
+// in the layer drops the other from o, so that it is not overridden by a
+// lower layer.
+func (o overrides) merge(layer overrides) {
+	for name, v := range layer {
+		for secret, file := range secretFiles {
+			if _, ok := layer[file]; name == secret && !ok {
+				delete(o, file)
+			}
+			if _, ok := layer[secret]; name == file && !ok {
+				delete(o, secret)
+			}
+		}
+
+		o[name] = v
+	}
+}
+
+// apply overlays the overrides onto cfg.
+func (o overrides) apply(cfg *config) error {
+	for name, v := range o {
+		var err error
+
+		switch name {
+		case "ip":
+			cfg.IP = net.ParseIP(v)
+			if cfg.IP == nil {
+				err = fmt.Errorf("invalid ip address %q", v)
+			}
+		case "mac":
+			cfg.MAC = v
+		case "type":
+			var t int64
+			t, err = strconv.ParseInt(v, 0, 0)
+			cfg.Type = int(t)
+		case "pin":
+			cfg.Pin = v
+			if _, ok := o["pin-file"]; !ok {
+				cfg.PinFile = ""
+			}
+		case "pin-file":
+			cfg.PinFile = v
+		case "port":
+			cfg.Port = v
+		case "data":
+			cfg.Data = v
+		case "metrics":
+			cfg.Metrics = v
+		case "api":
+			cfg.API = v
+		case "api-token":
+			cfg.APIToken = v
+			if _, ok := o["api-token-file"]; !ok {
+				cfg.APITokenFile = ""
+			}
+		case "api-token-file":
+			cfg.APITokenFile = v
+		case "mqtt":
+			cfg.MQTT = v
+		case "mqtt-username":
+			cfg.MQTTUsername = v
+		case "mqtt-password":
+			cfg.MQTTPassword = v
+			if _, ok := o["mqtt-password-file"]; !ok {
+				cfg.MQTTPasswordFile = ""
+			}
+		case "mqtt-password-file":
+			cfg.MQTTPasswordFile = v
+		case "mqtt-prefix":
+			cfg.MQTTPrefix = v
+		case "mqtt-discovery-prefix":
+			cfg.MQTTDiscoveryPrefix = v
+		case "min-interval-ms":
+			cfg.MinIntervalMs, err = strconv.Atoi(v)
+		case "device-models-file":
+			cfg.DeviceModelsFile = v
+		case "local-addr":
+			cfg.LocalAddr = v
+		case "ready-max-age-seconds":
+			cfg.ReadyMaxAgeSeconds, err = strconv.Atoi(v)
+		case "verbose":
+			cfg.Verbose, err = strconv.ParseBool(v)
+		case "log-level":
+			cfg.LogLevel = v
+		case "log-format":
+			cfg.LogFormat = v
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid %s setting: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// resolveSecrets reads the PIN, API token and MQTT password from their files
+// if set. The files take precedence over the values themselves so that
+// secrets never need to appear in process listings or the environment.
+func (c *config) resolveSecrets() error {
+	if c.PinFile != "" {
+		b, err := ioutil.ReadFile(c.PinFile)
+		if err != nil {
+			return fmt.Errorf("error reading pin file: %v", err)
+		}
+
+		c.Pin = strings.TrimSpace(string(b))
+	}
+
+	if c.APITokenFile != "" {
+		b, err := ioutil.ReadFile(c.APITokenFile)
+		if err != nil {
+			return fmt.Errorf("error reading api token file: %v", err)
+		}
+
+		c.APIToken = strings.TrimSpace(string(b))
+	}
+
+	if c.MQTTPasswordFile != "" {
+		b, err := ioutil.ReadFile(c.MQTTPasswordFile)
+		if err != nil {
+			return fmt.Errorf("error reading mqtt password file: %v", err)
+		}
+
+		c.MQTTPassword = strings.TrimSpace(string(b))
+	}
+
+	return nil
+}
+
+// isFlagSet reports whether the named flag was set when parsing fs.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
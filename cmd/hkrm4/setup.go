@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/util"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	setupCodeKey = "setupCode"
+	setupIDKey   = "setupID"
+)
+
+const setupIDChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// setupInfo is what a controller needs to pair with the bridge.
+type setupInfo struct {
+	Pin     string
+	SetupID string
+}
+
+// loadSetupInfo returns the setup code and setup ID for the install in dir.
+// If pin is empty a random setup code is generated on first run; both it and
+// the setup ID are stored so they stay the same across restarts.
+func loadSetupInfo(dir string, pin string) (*setupInfo, error) {
+	storage, err := util.NewFileStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if pin == "" {
+		pin, err = storedOrNew(storage, setupCodeKey, randomSetupCode)
+		if err != nil {
+			return nil, fmt.Errorf("error generating setup code: %v", err)
+		}
+	}
+
+	_, err = hc.ValidatePin(pin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pin: %v", err)
+	}
+
+	setupID, err := storedOrNew(storage, setupIDKey, randomSetupID)
+	if err != nil {
+		return nil, fmt.Errorf("error generating setup id: %v", err)
+	}
+
+	return &setupInfo{
+		Pin:     pin,
+		SetupID: setupID,
+	}, nil
+}
+
+func storedOrNew(storage util.Storage, key string, generate func() (string, error)) (string, error) {
+	b, err := storage.Get(key)
+	if err == nil && len(b) > 0 {
+		return string(b), nil
+	}
+
+	v, err := generate()
+	if err != nil {
+		return "", err
+	}
+
+	return v, storage.Set(key, []byte(v))
+}
+
+// randomSetupCode returns a random 8 digit setup code, excluding the trivial
+// codes which HAP forbids.
+func randomSetupCode() (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+		if err != nil {
+			return "", err
+		}
+
+		pin := fmt.Sprintf("%08d", n.Int64())
+		if _, err := hc.ValidatePin(pin); err == nil {
+			return pin, nil
+		}
+	}
+}
+
+func randomSetupID() (string, error) {
+	id := make([]byte, 4)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(setupIDChars))))
+		if err != nil {
+			return "", err
+		}
+
+		id[i] = setupIDChars[n.Int64()]
+	}
+
+	return string(id), nil
+}
+
+// formattedPin returns the setup code as shown to users, e.g. 123-45-678.
+func (s *setupInfo) formattedPin() string {
+	pin, _ := hc.ValidatePin(s.Pin)
+	return pin
+}
+
+// uri returns the X-HM:// setup payload encoded in the pairing QR code.
+func (s *setupInfo) uri() (string, error) {
+	return util.XHMURI(s.Pin, s.SetupID, uint8(accessory.TypeBridge), []util.SetupFlag{util.SetupFlagIP})
+}
+
+// printSetup logs the setup code and payload and prints the pairing QR code
+// to the terminal.
+func (s *setupInfo) printSetup() {
+	uri, err := s.uri()
+	if err != nil {
+		slog.Error("error creating setup payload", "error", err)
+		return
+	}
+
+	qr, err := qrcode.New(uri, qrcode.Medium)
+	if err != nil {
+		slog.Error("error creating setup QR code", "error", err)
+		return
+	}
+
+	slog.Info("HomeKit setup", "code", s.formattedPin(), "payload", uri)
+	fmt.Print(qr.ToSmallString(false))
+}
+
+// qrHandler serves the pairing QR code as a PNG.
+func (s *setupInfo) qrHandler(w http.ResponseWriter, r *http.Request) {
+	uri, err := s.uri()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+// unpairedQRHandler serves the pairing QR code only while no controller is
+// paired with the bridge whose data is stored in dir, since it is served
+// without authentication. The API serves it to token holders regardless.
+func (s *setupInfo) unpairedQRHandler(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		controllers, err := pairedControllers(dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(controllers) > 0 {
+			http.Error(w, "bridge is already paired", http.StatusNotFound)
+			return
+		}
+
+		s.qrHandler(w, r)
+	}
+}
+
+// pairedControllers returns the pairing IDs of the controllers paired with
+// the bridge whose data is stored in dir.
+func pairedControllers(dir string) ([]string, error) {
+	storage, err := util.NewFileStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := db.NewDatabaseWithStorage(storage).Entities()
+	if err != nil {
+		return nil, err
+	}
+
+	controllers := []string{}
+	for _, e := range entities {
+		// The bridge's own entity is the only one with a private key.
+		if len(e.PrivateKey) == 0 {
+			controllers = append(controllers, e.Name)
+		}
+	}
+
+	return controllers, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultStripType = 0x4eb5
+
+var stripSocketMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "hkrm4",
+	Subsystem: "strip",
+	Name:      "socket_on",
+	Help:      "Whether a socket of an MP1 power strip is on.",
+}, []string{"id", "socket"})
+
+// stripConfig is a Broadlink MP1 power strip, published as a single
+// accessory with an outlet for each socket.
+type stripConfig struct {
+	ID   string `json:"id" yaml:"id" toml:"id"`
+	Name string `json:"name" yaml:"name" toml:"name"`
+
+	IP   net.IP `json:"ip" yaml:"ip" toml:"ip"`
+	MAC  string `json:"mac" yaml:"mac" toml:"mac"`
+	Type int    `json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"`
+
+	// Sockets names the sockets in order. Sockets without a name are named
+	// after the strip.
+	Sockets []string `json:"sockets,omitempty" yaml:"sockets,omitempty" toml:"sockets,omitempty"`
+}
+
+func (s *stripConfig) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("has no name")
+	}
+
+	if s.IP == nil {
+		return fmt.Errorf("has no ip")
+	}
+
+	_, err := net.ParseMAC(s.MAC)
+	if err != nil {
+		return err
+	}
+
+	if len(s.Sockets) > broadlink.MP1Sockets {
+		return fmt.Errorf("has %d sockets, the MP1 has %d", len(s.Sockets), broadlink.MP1Sockets)
+	}
+
+	return nil
+}
+
+func (s *stripConfig) devType() int {
+	if s.Type == 0 {
+		return defaultStripType
+	}
+
+	return s.Type
+}
+
+// socketName returns the name of a socket, numbered from 1.
+func (s *stripConfig) socketName(socket int) string {
+	if socket <= len(s.Sockets) && s.Sockets[socket-1] != "" {
+		return s.Sockets[socket-1]
+	}
+
+	return fmt.Sprintf("%s %d", s.Name, socket)
+}
+
+func (s *stripConfig) key() string {
+	return s.ID
+}
+
+// sameDevice reports whether other addresses the same strip.
+func (s *stripConfig) sameDevice(other *stripConfig) bool {
+	return s.IP.Equal(other.IP) &&
+		s.MAC == other.MAC &&
+		s.devType() == other.devType()
+}
+
+// sameAccessory reports whether other would publish the same accessory.
+func (s *stripConfig) sameAccessory(other *stripConfig) bool {
+	if s.Name != other.Name {
+		return false
+	}
+
+	for i := 1; i <= broadlink.MP1Sockets; i++ {
+		if s.socketName(i) != other.socketName(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// strip is an MP1 power strip. Like a plug it connects and polls in the
+// background.
+type strip struct {
+	id   uint64
+	dev  *remoteDevice
+	log  *slog.Logger
+	stop chan struct{}
+
+	mu  sync.Mutex
+	cfg stripConfig
+	on  []bool
+
+	// Outlets of the currently published accessory.
+	outlets []*service.Outlet
+}
+
+func newStrip(id uint64, cfg stripConfig, log *slog.Logger) *strip {
+	dev := newRemoteDevice("strip", cfg.ID, cfg.IP, cfg.MAC, cfg.devType(), log)
+	dev.check = requirePower
+
+	s := &strip{
+		id:   id,
+		dev:  dev,
+		log:  log,
+		stop: make(chan struct{}),
+		cfg:  cfg,
+		on:   make([]bool, broadlink.MP1Sockets),
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *strip) config() stripConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cfg
+}
+
+// update replaces the config of a strip at the same address.
+func (s *strip) update(cfg stripConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cfg = cfg
+}
+
+// close stops polling and drops the strip's metrics.
+func (s *strip) close() {
+	close(s.stop)
+	s.dev.close()
+
+	id := s.config().ID
+	for i := 1; i <= broadlink.MP1Sockets; i++ {
+		stripSocketMetric.DeleteLabelValues(id, strconv.Itoa(i))
+	}
+}
+
+func (s *strip) run() {
+	pollEvery(plugPollInterval, s.stop, s.poll)
+}
+
+func (s *strip) poll() {
+	bl, err := s.dev.get()
+	if err != nil {
+		s.log.Warn(err.Error())
+		return
+	}
+
+	on, err := bl.CheckSocketPower()
+	if err != nil {
+		s.log.Warn("error polling strip", "error", err)
+		return
+	}
+
+	s.log.Debug("polled strip", "sockets", on)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copy(s.on, on)
+	s.updateMetrics()
+	s.updateChars()
+}
+
+// updateMetrics reports the believed state of each socket. s.mu must be
+// held.
+func (s *strip) updateMetrics() {
+	for i, on := range s.on {
+		v := 0.0
+		if on {
+			v = 1
+		}
+
+		stripSocketMetric.WithLabelValues(s.cfg.ID, strconv.Itoa(i+1)).Set(v)
+	}
+}
+
+// updateChars pushes the believed state to the published accessory. s.mu
+// must be held.
+func (s *strip) updateChars() {
+	for i, outlet := range s.outlets {
+		outlet.On.SetValue(s.on[i])
+		outlet.OutletInUse.SetValue(s.on[i])
+	}
+}
+
+// setOn switches a socket, numbered from 1.
+func (s *strip) setOn(socket int, on bool) error {
+	s.log.Debug("setting strip", "socket", socket, "on", on)
+
+	bl, err := s.dev.get()
+	if err != nil {
+		return err
+	}
+
+	err = bl.SetSocketPower(socket, on)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.on[socket-1] = on
+	s.updateMetrics()
+	s.updateChars()
+
+	return nil
+}
+
+// accessory builds a HomeKit accessory for the strip, with a named outlet
+// for each socket, from its current config and state.
+func (s *strip) accessory() *accessory.Accessory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := accessory.Info{
+		Name:         s.cfg.Name,
+		Manufacturer: "BroadLink",
+		Model:        "MP1",
+		SerialNumber: s.cfg.MAC,
+		ID:           s.id,
+	}
+
+	acc := accessory.New(info, accessory.TypeOutlet)
+
+	s.outlets = nil
+	for i := 1; i <= broadlink.MP1Sockets; i++ {
+		socket := i
+
+		outlet := service.NewOutlet()
+
+		name := characteristic.NewName()
+		name.SetValue(s.cfg.socketName(socket))
+		outlet.AddCharacteristic(name.Characteristic)
+
+		outlet.On.SetValue(s.on[socket-1])
+		outlet.On.OnValueRemoteUpdate(logError(s.log, func(on bool) error {
+			return s.setOn(socket, on)
+		}))
+
+		// The MP1 cannot measure power, so a socket is in use when on.
+		outlet.OutletInUse.SetValue(s.on[socket-1])
+
+		acc.AddService(outlet.Service)
+
+		s.outlets = append(s.outlets, outlet)
+	}
+
+	return acc
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/benpye/hkrm4/internal/broadlink"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultHysenType = 0x4e4d
+
+var (
+	thermostatTemperatureMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "thermostat",
+		Name:      "temperature_celsius",
+		Help:      "Temperature a thermostat regulates on, in degrees celsius.",
+	}, []string{"id"})
+
+	thermostatTargetMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "thermostat",
+		Name:      "target_temperature_celsius",
+		Help:      "Target temperature of a thermostat, in degrees celsius.",
+	}, []string{"id"})
+
+	thermostatHeatingMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hkrm4",
+		Subsystem: "thermostat",
+		Name:      "heating",
+		Help:      "Whether a thermostat is calling for heat.",
+	}, []string{"id"})
+
+	thermostatMetrics = []*prometheus.GaugeVec{
+		thermostatTemperatureMetric,
+		thermostatTargetMetric,
+		thermostatHeatingMetric,
+	}
+)
+
+// thermostatConfig is a Hysen heating controller.
+type thermostatConfig struct {
+	ID   string `json:"id" yaml:"id" toml:"id"`
+	Name string `json:"name" yaml:"name" toml:"name"`
+
+	IP   net.IP `json:"ip" yaml:"ip" toml:"ip"`
+	MAC  string `json:"mac" yaml:"mac" toml:"mac"`
+	Type int    `json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"`
+}
+
+func (t *thermostatConfig) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("has no name")
+	}
+
+	if t.IP == nil {
+		return fmt.Errorf("has no ip")
+	}
+
+	_, err := net.ParseMAC(t.MAC)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *thermostatConfig) devType() int {
+	if t.Type == 0 {
+		return defaultHysenType
+	}
+
+	return t.Type
+}
+
+func (t *thermostatConfig) key() string {
+	return t.ID
+}
+
+// sameDevice reports whether other addresses the same controller.
+func (t *thermostatConfig) sameDevice(other *thermostatConfig) bool {
+	return t.IP.Equal(other.IP) &&
+		t.MAC == other.MAC &&
+		t.devType() == other.devType()
+}
+
+// sameAccessory reports whether other would publish the same accessory.
+func (t *thermostatConfig) sameAccessory(other *thermostatConfig) bool {
+	return t.Name == other.Name
+}
+
+// thermostat is a Hysen heating controller published as a HomeKit
+// thermostat. HomeKit's heat and cool modes both hold the target set by
+// hand, auto follows the controller's own schedule.
+type thermostat struct {
+	id   uint64
+	dev  *remoteDevice
+	log  *slog.Logger
+	stop chan struct{}
+
+	mu     sync.Mutex
+	cfg    thermostatConfig
+	status broadlink.ThermostatStatus
+	polled bool
+
+	// Service of the currently published accessory.
+	svc *service.Thermostat
+}
+
+func newThermostat(id uint64, cfg thermostatConfig, log *slog.Logger) *thermostat {
+	dev := newRemoteDevice("thermostat", cfg.ID, cfg.IP, cfg.MAC, cfg.devType(), log)
+	dev.product = broadlink.ProductHysen
+
+	t := &thermostat{
+		id:   id,
+		dev:  dev,
+		log:  log,
+		stop: make(chan struct{}),
+		cfg:  cfg,
+	}
+
+	go t.run()
+
+	return t
+}
+
+func (t *thermostat) config() thermostatConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.cfg
+}
+
+// update replaces the config of a thermostat at the same address.
+func (t *thermostat) update(cfg thermostatConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cfg = cfg
+}
+
+// close stops polling and drops the thermostat's metrics.
+func (t *thermostat) close() {
+	close(t.stop)
+	t.dev.close()
+
+	id := t.config().ID
+	for _, m := range thermostatMetrics {
+		m.DeleteLabelValues(id)
+	}
+}
+
+func (t *thermostat) run() {
+	pollEvery(plugPollInterval, t.stop, t.poll)
+}
+
+func (t *thermostat) poll() {
+	bl, err := t.dev.get()
+	if err != nil {
+		t.log.Warn(err.Error())
+		return
+	}
+
+	id := t.config().ID
+
+	status, err := bl.ThermostatStatus()
+	if err != nil {
+		t.log.Warn("error polling thermostat", "error", err)
+		return
+	}
+
+	t.log.Debug("polled thermostat", "power", status.Power, "heating", status.Heating, "auto", status.Auto,
+		"temperature", status.Temperature(), "target", status.TargetTemperature)
+
+	heating := 0.0
+	if status.Power && status.Heating {
+		heating = 1
+	}
+
+	thermostatTemperatureMetric.WithLabelValues(id).Set(status.Temperature())
+	thermostatTargetMetric.WithLabelValues(id).Set(status.TargetTemperature)
+	thermostatHeatingMetric.WithLabelValues(id).Set(heating)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.status, t.polled = status, true
+	t.updateChars()
+}
+
+// mode returns the HomeKit target mode for the believed state. t.mu must be
+// held.
+func (t *thermostat) mode() int {
+	switch {
+	case !t.status.Power:
+		return characteristic.TargetHeatingCoolingStateOff
+	case t.status.Auto:
+		return characteristic.TargetHeatingCoolingStateAuto
+	default:
+		return characteristic.TargetHeatingCoolingStateHeat
+	}
+}
+
+// updateChars pushes the believed state to the published accessory. t.mu
+// must be held.
+func (t *thermostat) updateChars() {
+	if t.svc == nil || !t.polled {
+		return
+	}
+
+	current := characteristic.CurrentHeatingCoolingStateOff
+	if t.status.Power && t.status.Heating {
+		current = characteristic.CurrentHeatingCoolingStateHeat
+	}
+
+	t.svc.CurrentHeatingCoolingState.SetValue(current)
+	t.svc.TargetHeatingCoolingState.SetValue(t.mode())
+	t.svc.CurrentTemperature.SetValue(t.status.Temperature())
+	t.svc.TargetTemperature.SetValue(t.status.TargetTemperature)
+}
+
+func (t *thermostat) setMode(mode int) error {
+	t.log.Debug("setting thermostat", "mode", mode)
+
+	bl, err := t.dev.get()
+	if err != nil {
+		return err
+	}
+
+	if mode == characteristic.TargetHeatingCoolingStateOff {
+		err = bl.SetThermostatPower(false)
+	} else {
+		err = bl.SetThermostatAuto(mode == characteristic.TargetHeatingCoolingStateAuto)
+		if err == nil {
+			err = bl.SetThermostatPower(true)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	go t.poll()
+
+	return nil
+}
+
+func (t *thermostat) setTarget(temp float64) error {
+	t.log.Debug("setting thermostat", "target", temp)
+
+	bl, err := t.dev.get()
+	if err != nil {
+		return err
+	}
+
+	err = bl.SetThermostatTarget(temp)
+	if err != nil {
+		return err
+	}
+
+	go t.poll()
+
+	return nil
+}
+
+// accessory builds a HomeKit thermostat from the current config and state.
+func (t *thermostat) accessory() *accessory.Accessory {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info := accessory.Info{
+		Name:         t.cfg.Name,
+		Manufacturer: "Hysen",
+		Model:        "Heating Controller",
+		SerialNumber: t.cfg.MAC,
+		ID:           t.id,
+	}
+
+	acc := accessory.New(info, accessory.TypeThermostat)
+
+	svc := service.NewThermostat()
+	svc.TemperatureDisplayUnits.SetValue(characteristic.TemperatureDisplayUnitsCelsius)
+
+	svc.TargetTemperature.SetMinValue(5)
+	svc.TargetTemperature.SetMaxValue(35)
+	svc.TargetTemperature.SetStepValue(0.5)
+	if t.polled && t.status.MinTarget < t.status.MaxTarget {
+		svc.TargetTemperature.SetMinValue(t.status.MinTarget)
+		svc.TargetTemperature.SetMaxValue(t.status.MaxTarget)
+	}
+
+	svc.TargetHeatingCoolingState.OnValueRemoteUpdate(func(mode int) {
+		err := t.setMode(mode)
+		if err != nil {
+			t.log.Error("error setting thermostat mode", "error", err)
+		}
+	})
+
+	svc.TargetTemperature.OnValueRemoteUpdate(func(temp float64) {
+		err := t.setTarget(temp)
+		if err != nil {
+			t.log.Error("error setting thermostat target", "error", err)
+		}
+	})
+
+	acc.AddService(svc.Service)
+
+	t.svc = svc
+	t.updateChars()
+
+	return acc
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const configPollInterval = 2 * time.Second
+
+// watchConfig signals on reload whenever the file at path is modified or the
+// process receives SIGHUP. The file is polled rather than watched so that
+// editors which replace the file on save are handled.
+func watchConfig(path string, reload chan<- struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	var lastSize int64
+	if fi, err := os.Stat(path); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+
+			if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+				continue
+			}
+
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+		}
+
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// webHandler serves the web UI. The UI is static and drives hkrm4 through
+// the control API, so it needs the API token to do anything.
+func webHandler() http.Handler {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.FileServer(http.FS(root))
+}
@@ -0,0 +1,243 @@
+"use strict";
+
+const api = "/api/v1";
+
+let token = localStorage.getItem("hkrm4-token") || "";
+let learnTarget = null;
+let learnedCode = null;
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function el(tag, props, ...children) {
+  const e = document.createElement(tag);
+  Object.assign(e, props || {});
+  e.append(...children);
+  return e;
+}
+
+function status(msg) {
+  $("status").textContent = msg || "";
+}
+
+async function request(method, path, body) {
+  const res = await fetch(api + path, {
+    method: method,
+    headers: {
+      "Authorization": "Bearer " + token,
+      "Content-Type": "application/json",
+    },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+
+  if (res.status === 401) {
+    showLogin();
+    throw new Error("not signed in");
+  }
+
+  if (!res.ok) {
+    const err = await res.json().catch(() => ({ error: res.statusText }));
+    throw new Error(err.error);
+  }
+
+  if (res.status === 204) {
+    return null;
+  }
+
+  const type = res.headers.get("Content-Type") || "";
+  return type.startsWith("application/json") ? res.json() : res.blob();
+}
+
+function showLogin() {
+  for (const s of document.querySelectorAll("main > section")) {
+    s.hidden = s.id !== "login";
+  }
+}
+
+function showPage() {
+  const page = location.hash.slice(1) || "devices";
+  for (const s of document.querySelectorAll("main > section")) {
+    s.hidden = s.id !== page;
+  }
+
+  status();
+  (page === "pairing" ? loadPairing() : loadDevices()).catch((e) => status(e.message));
+}
+
+async function loadDevices() {
+  const [devices, accessories, macros, commands] = await Promise.all([
+    request("GET", "/devices"),
+    request("GET", "/accessories"),
+    request("GET", "/macros"),
+    request("GET", "/commands"),
+  ]);
+
+  $("hubs").replaceChildren(...devices.map(hubCard));
+  $("accessories").replaceChildren(...accessories.map(accessoryCard));
+  $("macros").replaceChildren(...macros.map(macroCard));
+  $("commands").replaceChildren(...commands.map((name) => el("span", { className: "command" },
+    el("button", { title: "Send", onclick: () => send("", name) }, name))));
+
+  for (const d of devices) {
+    loadSensors(d.id);
+  }
+}
+
+function hubCard(d) {
+  return el("div", { className: "card", id: "hub-" + d.id },
+    el("h3", {}, d.id),
+    el("p", {}, `${d.ip} · ${d.mac} · type 0x${d.type.toString(16)}`),
+    el("p", { className: "sensors" }, "Reading sensors…"));
+}
+
+async function loadSensors(id) {
+  const p = document.querySelector(`#hub-${id} .sensors`);
+  try {
+    const s = await request("GET", "/sensors");
+    p.textContent = `${s.temperature.toFixed(1)} °C · ${s.humidity.toFixed(0)} % humidity`;
+  } catch (e) {
+    p.textContent = "Sensors unavailable: " + e.message;
+  }
+}
+
+function accessoryCard(a) {
+  const state = `Fan ${a.state.on ? "on" : "off"} at ${a.state.speed}% · light ${a.state.light ? "on" : "off"}`;
+
+  const commands = a.commands.map((name) => el("span", { className: "command" },
+    el("button", { title: "Send", onclick: () => send(a.id, name) }, name),
+    el("button", { title: "Learn a new code", onclick: () => openLearn(a, name) }, "learn")));
+
+  const actions = a.speedMode === "relative"
+    ? [el("button", { title: "Press speed down to the lowest level, then restore the speed", onclick: () => home(a) }, "Resync speed")]
+    : [];
+
+  return el("div", { className: "card" },
+    el("h3", {}, a.name),
+    el("p", {}, state, ...actions),
+    el("div", { className: "commands" }, ...commands));
+}
+
+async function home(a) {
+  try {
+    await request("POST", `/accessories/${encodeURIComponent(a.id)}/home`);
+    status();
+  } catch (e) {
+    status(`Resyncing ${a.name} failed: ${e.message}`);
+  }
+}
+
+function macroCard(m) {
+  return el("div", { className: "card" },
+    el("h3", {}, m.name),
+    el("button", { onclick: () => runMacro(m) }, "Run"));
+}
+
+async function runMacro(m) {
+  try {
+    await request("POST", `/macros/${encodeURIComponent(m.id)}/run`);
+    status();
+  } catch (e) {
+    status(`Running ${m.name} failed: ${e.message}`);
+  }
+}
+
+async function send(accessory, command) {
+  try {
+    await request("POST", "/send", { accessory: accessory, command: command });
+    status();
+  } catch (e) {
+    status(`Sending ${command} failed: ${e.message}`);
+  }
+}
+
+function openLearn(accessory, command) {
+  learnTarget = { accessory: accessory.id, command: command };
+  learnedCode = null;
+
+  $("learn-target").textContent = `${accessory.name} ${command}`;
+  $("learn-code").textContent = "-";
+  $("learn-hint").textContent = "";
+  $("learn-status").textContent = "";
+  $("learn-test").disabled = true;
+  $("learn-save").disabled = true;
+  $("learn").showModal();
+}
+
+async function learn() {
+  const kind = $("learn-kind").value;
+  $("learn-start").disabled = true;
+  $("learn-status").textContent = "";
+  $("learn-hint").textContent = kind === "rf"
+    ? "Hold the button on the remote until the frequency is found, then press it again."
+    : "Point the remote at the hub and press the button.";
+
+  try {
+    const res = await request("POST", "/learn", { kind: kind });
+    learnedCode = res.code;
+    $("learn-code").textContent = learnedCode;
+    $("learn-test").disabled = false;
+    $("learn-save").disabled = false;
+  } catch (e) {
+    $("learn-status").textContent = "Learning failed: " + e.message;
+  } finally {
+    $("learn-start").disabled = false;
+    $("learn-hint").textContent = "";
+  }
+}
+
+async function testLearned() {
+  try {
+    await request("POST", "/send", { code: learnedCode });
+    $("learn-status").textContent = "";
+  } catch (e) {
+    $("learn-status").textContent = "Sending failed: " + e.message;
+  }
+}
+
+async function saveLearned() {
+  const t = learnTarget;
+  try {
+    await request("PUT", `/accessories/${encodeURIComponent(t.accessory)}/commands/${encodeURIComponent(t.command)}`, { code: learnedCode });
+    $("learn").close();
+    status(`Saved ${t.command}, the config will be reloaded.`);
+  } catch (e) {
+    $("learn-status").textContent = "Saving failed: " + e.message;
+  }
+}
+
+async function loadPairing() {
+  const [info, qr] = await Promise.all([
+    request("GET", "/pairing"),
+    request("GET", "/pairing/qr.png"),
+  ]);
+
+  $("qr").src = URL.createObjectURL(qr);
+  $("setup-code").textContent = info.setupCode;
+  $("setup-payload").textContent = info.setupPayload;
+
+  const controllers = info.controllers.length > 0
+    ? info.controllers.map((c) => el("li", {}, c))
+    : [el("li", {}, "No controllers are paired.")];
+  $("controllers").replaceChildren(...controllers);
+}
+
+$("login-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  token = $("token").value;
+  localStorage.setItem("hkrm4-token", token);
+  showPage();
+});
+
+$("learn-start").addEventListener("click", learn);
+$("learn-test").addEventListener("click", testLearned);
+$("learn-save").addEventListener("click", saveLearned);
+$("learn-close").addEventListener("click", () => $("learn").close());
+
+window.addEventListener("hashchange", showPage);
+
+if (token) {
+  showPage();
+} else {
+  showLogin();
+}
@@ -1,6 +1,8 @@
 {
   description = "A flake for building hkrm4.";
 
+  # go.mod needs Go 1.21 or later, for log/slog.
+  inputs.nixpkgs.url = "github:NixOS/nixpkgs/nixos-24.05";
   inputs.flake-utils.url = "github:numtide/flake-utils";
 
   outputs = { self, nixpkgs, flake-utils }:
@@ -11,10 +13,10 @@
     in
     {
       overlay = self: super: {
-        ${name} = super.buildGoModule {
+        ${name} = super.buildGo122Module {
           inherit name src;
           version = "2022-01-28";
-          vendorSha256 = "sha256-w5VEKWdY+kQyWEvKRZ6FovfzpwRW+zt2lFKylndvhU4=";
+          vendorHash = "sha256-MLplyTpXMEW6IVp0GpGsvNWWawSGG3fUb7cwv8yaMNs=";
           subPackages = [ "cmd/hkrm4" ];
         };
       };
@@ -0,0 +1,62 @@
+package broadlink
+
+import "fmt"
+
+// Light levels reported by the A1.
+const (
+	LightDark = iota
+	LightDim
+	LightNormal
+	LightBright
+)
+
+// Air quality levels reported by the A1.
+const (
+	AirExcellent = iota
+	AirGood
+	AirNormal
+	AirBad
+)
+
+// Noise levels reported by the A1.
+const (
+	NoiseQuiet = iota
+	NoiseNormal
+	NoiseNoisy
+)
+
+// Environment is a reading from an A1 environmental sensor. Light,
+// AirQuality and Noise are coarse levels rather than measurements.
+type Environment struct {
+	Temperature float64
+	Humidity    float64
+	Light       int
+	AirQuality  int
+	Noise       int
+}
+
+// CheckEnvironment reads all the sensors of an A1.
+func (d *Device) CheckEnvironment() (Environment, error) {
+	req := unencryptedRequest{
+		command: 0x6a,
+		payload: make([]byte, 16),
+	}
+	req.payload[0] = 0x01
+
+	resp, err := d.serverRequest(req)
+	if err != nil {
+		return Environment{}, fmt.Errorf("error making CheckEnvironment request: %v", err)
+	}
+
+	if len(resp) < 9 {
+		return Environment{}, fmt.Errorf("short CheckEnvironment response: %d bytes", len(resp))
+	}
+
+	return Environment{
+		Temperature: float64(resp[0]) + float64(resp[1])/10.0,
+		Humidity:    float64(resp[2]) + float64(resp[3])/10.0,
+		Light:       int(resp[4]),
+		AirQuality:  int(resp[6]),
+		Noise:       int(resp[8]),
+	}, nil
+}
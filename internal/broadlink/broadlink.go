@@ -7,16 +7,25 @@ import (
 
 const defaultTimeout = 5 // seconds
 
-func NewDevice(ip net.IP, mac net.HardwareAddr, deviceType int) (*Device, error) {
-	devChar := isKnownDevice(deviceType)
-	if !devChar.supported {
-		return nil, fmt.Errorf("device type %v (0x%04x) is not supported", deviceType, deviceType)
+// NewDevice connects to a device of a model in DefaultRegistry.
+func NewDevice(ip net.IP, mac net.HardwareAddr, deviceType int, opts ...Option) (*Device, error) {
+	return DefaultRegistry.NewDevice(ip, mac, deviceType, opts...)
+}
+
+// WithRepeat returns a copy of an IR or RF code with the repeat byte of its
+// packet set, so that the device transmits it count+1 times.
+func WithRepeat(data []byte, count int) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("code is too short: %d bytes", len(data))
 	}
 
-	device, err := newDevice(ip, mac, defaultTimeout, devChar)
-	if err != nil {
-		return nil, err
+	if count < 0 || count > 0xff {
+		return nil, fmt.Errorf("repeat count %d is out of range 0-255", count)
 	}
 
-	return device, nil
+	out := make([]byte, len(data))
+	copy(out, data)
+	out[1] = byte(count)
+
+	return out, nil
 }
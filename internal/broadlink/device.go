@@ -5,8 +5,11 @@ import (
 	"crypto/cipher"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,17 +41,68 @@ type Response struct {
 	Data []byte
 }
 
+// DeviceInfo describes a device's model and what it can do.
+type DeviceInfo struct {
+	Name  string
+	Type  int
+	IR    bool
+	RF    bool
+	Power bool
+	// Energy reports whether the device is a metering plug.
+	Energy bool
+}
+
 type Device struct {
-	remoteAddr        net.IP
-	timeout           int
-	deviceType        int
-	mac               net.HardwareAddr
-	count             uint16
-	key               []byte
-	iv                []byte
-	id                []byte
-	requestHeader     []byte
-	codeSendingHeader []byte
+	remoteAddr net.IP
+	dest       *net.UDPAddr
+	localAddr  string
+	sock       *socket
+	log        *slog.Logger
+	observer   Observer
+
+	// authenticated is set while the device has a session with us.
+	authenticated atomic.Bool
+	timeout       int
+	model         Model
+	mac           net.HardwareAddr
+	count         uint16
+	key           []byte
+	iv            []byte
+	id            []byte
+	product       Product
+
+	// reqMu serialises requests, which share the key and packet count.
+	reqMu sync.Mutex
+
+	sendMu      sync.Mutex
+	minInterval time.Duration
+	nextSend    time.Time
+}
+
+// Option configures a device before it connects.
+type Option func(*Device)
+
+// LocalAddr binds the device's socket to a fixed local address and port,
+// e.g. "0.0.0.0:40000", so that a firewall can allow its traffic narrowly.
+// Devices given the same address share one socket.
+func LocalAddr(addr string) Option {
+	return func(d *Device) {
+		d.localAddr = addr
+	}
+}
+
+// WithObserver reports the device's requests to o.
+func WithObserver(o Observer) Option {
+	return func(d *Device) {
+		d.observer = o
+	}
+}
+
+// WithLogger makes the device log through l rather than slog.Default.
+func WithLogger(l *slog.Logger) Option {
+	return func(d *Device) {
+		d.log = l
+	}
 }
 
 type unencryptedRequest struct {
@@ -56,87 +110,263 @@ type unencryptedRequest struct {
 	payload []byte
 }
 
-func newDevice(remoteAddr net.IP, mac net.HardwareAddr, timeout int, devChar deviceCharacteristics) (*Device, error) {
+func newDevice(remoteAddr net.IP, mac net.HardwareAddr, timeout int, model Model, opts ...Option) (*Device, error) {
 	rand.Seed(time.Now().Unix())
+
+	// Authentication overwrites the key and ID in place, so each device
+	// needs its own copies rather than slices of the package arrays.
+	key, iv, id := initialKey, initialIV, initialID
+
 	d := &Device{
-		remoteAddr:        remoteAddr,
-		timeout:           timeout,
-		deviceType:        devChar.deviceType,
-		mac:               mac,
-		count:             uint16(rand.Uint32()),
-		key:               initialKey[:],
-		iv:                initialIV[:],
-		id:                initialID[:],
-		requestHeader:     devChar.requestHeader,
-		codeSendingHeader: devChar.codeSendingHeader,
-	}
-
-	_, err := d.serverRequest(authenticatePayload())
+		remoteAddr: remoteAddr,
+		dest:       &net.UDPAddr{IP: remoteAddr, Port: 80},
+		timeout:    timeout,
+		model:      model,
+		mac:        mac,
+		count:      uint16(rand.Uint32()),
+		key:        key[:],
+		iv:         iv[:],
+		id:         id[:],
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if d.log == nil {
+		d.log = slog.Default()
+	}
+
+	d.log = d.log.With("mac", mac.String())
+
+	sock, err := openSocket(d.localAddr)
 	if err != nil {
-		return d, fmt.Errorf("error making authentication request: %v", err)
+		return nil, err
+	}
+
+	d.sock = sock
+
+	_, err = d.serverRequest(authenticatePayload())
+	if derr, ok := err.(*StatusError); ok && derr.Code == errCodeAuthFailed {
+		// A locked device refuses authentication like any other failure,
+		// so ask it whether it is locked.
+		_, locked, herr := d.hello()
+		if herr == nil && locked {
+			d.Close()
+			return nil, ErrLocked
+		}
+	}
+
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("error making authentication request: %v", err)
 	}
 
 	return d, nil
 }
 
-// serverRequest sends a request to the device and waits for a response.
+// Close releases the device's socket. The device must not be used after.
+func (d *Device) Close() error {
+	d.reqMu.Lock()
+	defer d.reqMu.Unlock()
+
+	if d.sock != nil {
+		d.sock.release()
+		d.sock = nil
+	}
+
+	return nil
+}
+
+// reauthenticate starts a new session with a device which has forgotten the
+// old one, after a request failed with cause. The request lock is held from
+// dropping the old key until the new one arrives, so that no other request
+// is sent under the initial key.
+func (d *Device) reauthenticate(cause error) error {
+	d.log.Info("device lost its session, authenticating again", "error", cause)
+	if d.observer != nil {
+		d.observer.Reauth()
+	}
+
+	d.reqMu.Lock()
+	defer d.reqMu.Unlock()
+
+	if d.sock == nil {
+		return errors.New("device is closed")
+	}
+
+	key, id := initialKey, initialID
+	d.key, d.id = key[:], id[:]
+	d.authenticated.Store(false)
+
+	_, err := d.request(authenticatePayload())
+	if err != nil {
+		return fmt.Errorf("error making authentication request: %v", err)
+	}
+
+	return nil
+}
+
+// Authenticated reports whether the device has a session with us, which it
+// does from connecting until it forgets the session and cannot be
+// authenticated again.
+func (d *Device) Authenticated() bool {
+	return d.authenticated.Load()
+}
+
+// Info returns the model name, type and capabilities of the device.
+func (d *Device) Info() DeviceInfo {
+	return DeviceInfo{
+		Name:   d.model.Name,
+		Type:   d.model.Type,
+		IR:     d.model.IR,
+		RF:     d.model.RF,
+		Power:  d.model.Power,
+		Energy: d.model.Energy,
+	}
+}
+
+// serverRequest sends a request to the device and waits for a response,
+// returning the payload without its header.
 func (d *Device) serverRequest(req unencryptedRequest) ([]byte, error) {
+	payload, err := d.sessionRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.model.TrimResponse != nil && req.command != 0x65 {
+		return d.model.TrimResponse(payload), nil
+	}
+
+	header := d.model.RequestHeader
+
+	// Devices with a request header prefix the payload with its length,
+	// the rest is padding.
+	if len(header) > 0 && req.command != 0x65 {
+		pLen := (int)(payload[0]) | ((int)(payload[1]) << 8)
+		if pLen+2 >= len(header)+0x4 && pLen+2 <= len(payload) {
+			payload = payload[:pLen+2]
+		}
+	}
+
+	return payload[len(header)+0x4:], nil
+}
+
+// sessionRequest is rawServerRequest, authenticating again and retrying
+// once if the device has forgotten our session.
+func (d *Device) sessionRequest(req unencryptedRequest) ([]byte, error) {
+	payload, err := d.rawServerRequest(req)
+	if req.command != 0x65 && sessionLost(err) {
+		err = d.reauthenticate(err)
+		if err == nil {
+			payload, err = d.rawServerRequest(req)
+		}
+	}
+
+	return payload, err
+}
+
+// rawServerRequest sends a request to the device and waits for a response,
+// returning the whole decrypted payload.
+func (d *Device) rawServerRequest(req unencryptedRequest) ([]byte, error) {
+	d.reqMu.Lock()
+	defer d.reqMu.Unlock()
+
+	if d.sock == nil {
+		return nil, errors.New("device is closed")
+	}
+
+	return d.request(req)
+}
+
+// request is rawServerRequest with d.reqMu already held.
+func (d *Device) request(req unencryptedRequest) ([]byte, error) {
+	start := time.Now()
+	resp, err := d.exchange(req)
+	latency := time.Since(start)
+
+	result := resultOf(err)
+	if d.observer != nil {
+		d.observer.Request(req.command, result, latency)
+	}
+
+	if err != nil {
+		d.log.Debug("request failed", commandAttr(req.command), "result", result, "latency", latency, "error", err)
+		return nil, err
+	}
+
+	d.log.Debug("request", commandAttr(req.command), "latency", latency)
+
+	return resp, nil
+}
+
+// exchange sends a request and waits for its response. d.reqMu must be
+// held.
+func (d *Device) exchange(req unencryptedRequest) ([]byte, error) {
 	encryptedReq, err := d.encryptRequest(req)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.ListenPacket("udp4", "")
+	d.tracePacket("sending packet", req.command, encryptedReq, req.payload)
+
+	// The reply is routed to us by the packet count it echoes, so we must
+	// be waiting for it before the request goes out.
+	key := replyKey{ip: d.remoteAddr.String(), count: d.count}
+	replies, err := d.sock.expect(key)
 	if err != nil {
 		return nil, err
 	}
 
-	defer conn.Close()
+	defer d.sock.forget(key)
 
 	retries := 0
 	for {
 		retries++
 
-		destAddr, err := net.ResolveUDPAddr("udp", d.remoteAddr.String()+":80")
-		if err != nil {
-			err = fmt.Errorf("could not resolve device address %v: %v", d.remoteAddr, err)
-			return nil, err
+		_, err = d.sock.conn.WriteTo(encryptedReq, d.dest)
+		if err == nil {
+			break
 		}
 
-		_, err = conn.WriteTo(encryptedReq, destAddr)
-		if err != nil {
-			if retries < sendRetries {
-				continue
-			}
-
-			err = fmt.Errorf("could not send packet: %v", err)
-			return nil, err
+		if retries >= sendRetries {
+			return nil, fmt.Errorf("could not send packet: %v", err)
 		}
 
-		conn.SetReadDeadline(time.Now().Add(time.Duration(d.timeout) * time.Second))
-
-		var buf [2048]byte
-		plen, _, err := conn.ReadFrom(buf[:])
-		if err != nil {
-			return nil, fmt.Errorf("error while waiting for device response: %v", err)
+		d.log.Warn("retrying send", commandAttr(req.command), "error", err)
+		if d.observer != nil {
+			d.observer.Retry(req.command)
 		}
+	}
 
-		if plen < 0x30 {
-			return nil, fmt.Errorf("expected at least 0x30 bytes, got: %d", plen)
-		}
+	timer := time.NewTimer(time.Duration(d.timeout) * time.Second)
+	defer timer.Stop()
 
-		err = d.checkError(buf[:plen])
-		if err != nil {
-			return nil, err
+	var buf []byte
+	select {
+	case b, ok := <-replies:
+		if !ok {
+			return nil, fmt.Errorf("error while waiting for device response: %v", d.sock.failure())
 		}
 
-		resp, err := d.decryptResponse(buf[:plen])
-		if err != nil {
-			return nil, err
-		}
+		buf = b
+	case <-timer.C:
+		return nil, errTimeout
+	}
 
-		return resp, nil
+	err = d.checkError(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.decryptResponse(buf)
+	if err != nil {
+		return nil, err
 	}
+
+	d.tracePacket("received packet", buf[0x26], buf, resp)
+
+	return resp, nil
 }
 
 func (d *Device) encryptRequest(req unencryptedRequest) ([]byte, error) {
@@ -203,10 +433,49 @@ func (d *Device) encryptRequest(req unencryptedRequest) ([]byte, error) {
 	return packet, nil
 }
 
+// StatusError is an error code returned by the device.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error code %d", e.Code)
+}
+
+// Error codes which mean the device has forgotten our session, typically
+// because it restarted, or that the session key has expired.
+const (
+	errCodeAuthFailed = -1
+	errCodeLoggedOut  = -2
+	errCodeKeyExpired = -7
+)
+
+// sessionLost reports whether err means the device needs authenticating
+// again.
+func sessionLost(err error) bool {
+	serr, ok := err.(*StatusError)
+	if !ok {
+		return false
+	}
+
+	switch serr.Code {
+	case errCodeAuthFailed, errCodeLoggedOut, errCodeKeyExpired:
+		return true
+	}
+
+	return false
+}
+
+var errTimeout = errors.New("error while waiting for device response: timed out")
+
+// ErrLocked is returned by NewDevice for a device locked by the vendor app,
+// which refuses local control until it is unlocked or factory reset.
+var ErrLocked = errors.New("device is locked")
+
 func (d *Device) checkError(resp []byte) error {
-	errorCode := (int)(resp[0x22]) | ((int)(resp[0x23]) << 8)
+	errorCode := int(int16(uint16(resp[0x22]) | uint16(resp[0x23])<<8))
 	if errorCode != 0 {
-		return fmt.Errorf("error code %d", errorCode)
+		return &StatusError{Code: errorCode}
 	}
 	return nil
 }
@@ -233,13 +502,49 @@ func (d *Device) decryptResponse(resp []byte) ([]byte, error) {
 	if command == 0xe9 {
 		copy(d.key, payload[0x04:0x14])
 		copy(d.id, payload[:0x04])
+		d.authenticated.Store(true)
 	}
 
-	return payload[len(d.requestHeader)+0x4:], nil
+	return payload, nil
+}
+
+// SetMinInterval sets the minimum time from the end of one transmission, once
+// the device has acknowledged it, to the start of the next. SendData waits as
+// needed, so that a burst of sends does not flood the emitter.
+func (d *Device) SetMinInterval(interval time.Duration) {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	d.minInterval = interval
 }
 
 func (d *Device) SendData(data []byte) error {
-	header := d.codeSendingHeader
+	return d.SendDataGap(data, 0)
+}
+
+// SendDataGap sends data and then holds off the next transmission for at
+// least gap, or the minimum interval if that is longer.
+func (d *Device) SendDataGap(data []byte, gap time.Duration) error {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	if wait := time.Until(d.nextSend); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	err := d.sendData(data)
+
+	if gap < d.minInterval {
+		gap = d.minInterval
+	}
+
+	d.nextSend = time.Now().Add(gap)
+
+	return err
+}
+
+func (d *Device) sendData(data []byte) error {
+	header := d.model.CodeSendingHeader
 
 	reqLength := (len(header) + len(data) + 4 + 15) / 16 * 16
 	reqPayload := make([]byte, reqLength, reqLength)
@@ -269,12 +574,151 @@ func (d *Device) CheckSensors() (float64, float64, error) {
 		return 0, 0, fmt.Errorf("error making CheckSensors request: %v", err)
 	}
 
-	temperature := float64(resp[0]) + float64(resp[1])/100.0
-	humidity := float64(resp[2]) + float64(resp[3])/100.0
+	if d.model.DecodeSensors != nil {
+		return d.model.DecodeSensors(resp)
+	}
+
+	if len(resp) < 4 {
+		return 0, 0, fmt.Errorf("short CheckSensors response: %d bytes", len(resp))
+	}
+
+	scale := 100.0
+	if d.model.SensorScale != 0 {
+		scale = float64(d.model.SensorScale)
+	}
+
+	temperature := float64(resp[0]) + float64(resp[1])/scale
+	humidity := float64(resp[2]) + float64(resp[3])/scale
 
 	return temperature, humidity, nil
 }
 
+// EnterLearning puts the device into IR learning mode.
+func (d *Device) EnterLearning() error {
+	_, err := d.serverRequest(d.basicPayload(0x03))
+	if err != nil {
+		return fmt.Errorf("error making EnterLearning request: %v", err)
+	}
+
+	return nil
+}
+
+// CheckData returns the code captured in learning mode. The device returns
+// an error until a code has been captured.
+func (d *Device) CheckData() ([]byte, error) {
+	resp, err := d.serverRequest(d.basicPayload(0x04))
+	if err != nil {
+		return nil, fmt.Errorf("error making CheckData request: %v", err)
+	}
+
+	return resp, nil
+}
+
+// SweepFrequency starts scanning for the frequency of an RF remote.
+func (d *Device) SweepFrequency() error {
+	_, err := d.serverRequest(d.basicPayload(0x19))
+	if err != nil {
+		return fmt.Errorf("error making SweepFrequency request: %v", err)
+	}
+
+	return nil
+}
+
+// CheckFrequency reports whether a frequency sweep has found the remote.
+func (d *Device) CheckFrequency() (bool, error) {
+	resp, err := d.serverRequest(d.basicPayload(0x1a))
+	if err != nil {
+		return false, fmt.Errorf("error making CheckFrequency request: %v", err)
+	}
+
+	return len(resp) > 0 && resp[0] == 1, nil
+}
+
+// FindRFPacket puts the device into RF learning mode at the frequency found
+// by the last sweep.
+func (d *Device) FindRFPacket() error {
+	_, err := d.serverRequest(d.basicPayload(0x1b))
+	if err != nil {
+		return fmt.Errorf("error making FindRFPacket request: %v", err)
+	}
+
+	return nil
+}
+
+// CancelSweep stops a frequency sweep.
+func (d *Device) CancelSweep() error {
+	_, err := d.serverRequest(d.basicPayload(0x1e))
+	if err != nil {
+		return fmt.Errorf("error making CancelSweep request: %v", err)
+	}
+
+	return nil
+}
+
+// waitForData polls CheckData until a code is captured or the learning
+// timeout expires.
+func (d *Device) waitForData(deadline time.Time) ([]byte, error) {
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+
+		data, err := d.CheckData()
+		if err == nil && len(data) > 0 {
+			return data, nil
+		}
+	}
+
+	return nil, errors.New("timed out waiting for a code")
+}
+
+// Learn captures an IR code. The remote's button must be pressed within
+// the learning timeout.
+func (d *Device) Learn() ([]byte, error) {
+	err := d.EnterLearning()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.waitForData(time.Now().Add(learnTimeout * time.Second))
+}
+
+// LearnRF captures an RF code. The remote's button must be held until the
+// frequency is found, and then pressed again, all within the learning
+// timeout.
+func (d *Device) LearnRF() ([]byte, error) {
+	deadline := time.Now().Add(learnTimeout * time.Second)
+
+	err := d.SweepFrequency()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if time.Now().After(deadline) {
+			d.CancelSweep()
+			return nil, errors.New("timed out waiting for the remote frequency")
+		}
+
+		time.Sleep(time.Second)
+
+		found, err := d.CheckFrequency()
+		if err != nil {
+			d.CancelSweep()
+			return nil, err
+		}
+
+		if found {
+			break
+		}
+	}
+
+	err = d.FindRFPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.waitForData(deadline)
+}
+
 func authenticatePayload() unencryptedRequest {
 	req := unencryptedRequest{
 		command: 0x65,
@@ -310,7 +754,7 @@ func authenticatePayload() unencryptedRequest {
 
 func (d *Device) basicPayload(command byte) unencryptedRequest {
 	payload := make([]byte, 16, 16)
-	header := d.requestHeader
+	header := d.model.RequestHeader
 	copy(payload, header)
 	payload[len(header)] = command
 
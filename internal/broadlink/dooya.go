@@ -0,0 +1,75 @@
+package broadlink
+
+import "fmt"
+
+// Dooya DT360E commands.
+const (
+	dooyaOpen     = 0x01
+	dooyaClose    = 0x02
+	dooyaStop     = 0x03
+	dooyaPosition = 0x06
+)
+
+func (d *Device) dooyaRequest(command, attribute byte) (byte, error) {
+	req := unencryptedRequest{
+		command: 0x6a,
+		payload: make([]byte, 16),
+	}
+	req.payload[0x00] = 0x09
+	req.payload[0x02] = 0xbb
+	req.payload[0x03] = command
+	req.payload[0x04] = attribute
+	req.payload[0x09] = 0xfa
+	req.payload[0x0a] = 0x44
+
+	resp, err := d.serverRequest(req)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(resp) < 1 {
+		return 0, fmt.Errorf("empty curtain response")
+	}
+
+	return resp[0], nil
+}
+
+// OpenCurtain starts a Dooya curtain motor opening fully.
+func (d *Device) OpenCurtain() error {
+	_, err := d.dooyaRequest(dooyaOpen, 0x00)
+	if err != nil {
+		return fmt.Errorf("error making OpenCurtain request: %v", err)
+	}
+
+	return nil
+}
+
+// CloseCurtain starts a Dooya curtain motor closing fully.
+func (d *Device) CloseCurtain() error {
+	_, err := d.dooyaRequest(dooyaClose, 0x00)
+	if err != nil {
+		return fmt.Errorf("error making CloseCurtain request: %v", err)
+	}
+
+	return nil
+}
+
+// StopCurtain stops a Dooya curtain motor where it is.
+func (d *Device) StopCurtain() error {
+	_, err := d.dooyaRequest(dooyaStop, 0x00)
+	if err != nil {
+		return fmt.Errorf("error making StopCurtain request: %v", err)
+	}
+
+	return nil
+}
+
+// CurtainPosition returns how far open a Dooya curtain is, in percent.
+func (d *Device) CurtainPosition() (int, error) {
+	pos, err := d.dooyaRequest(dooyaPosition, 0x5d)
+	if err != nil {
+		return 0, fmt.Errorf("error making CurtainPosition request: %v", err)
+	}
+
+	return int(pos), nil
+}
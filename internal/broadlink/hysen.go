@@ -0,0 +1,176 @@
+package broadlink
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ThermostatStatus is the state of a Hysen heating controller.
+type ThermostatStatus struct {
+	Locked bool
+	Power  bool
+	// Heating reports whether the controller is calling for heat.
+	Heating bool
+	// Auto reports whether the controller follows its schedule rather
+	// than a manually set target.
+	Auto bool
+	// Sensor is 0 for the internal sensor, 1 for the external sensor and
+	// 2 for the internal sensor limited by the external one.
+	Sensor int
+
+	RoomTemperature     float64
+	ExternalTemperature float64
+	TargetTemperature   float64
+	MinTarget           float64
+	MaxTarget           float64
+
+	loopMode byte
+}
+
+// Temperature returns the temperature the controller regulates on.
+func (s ThermostatStatus) Temperature() float64 {
+	if s.Sensor == 1 {
+		return s.ExternalTemperature
+	}
+
+	return s.RoomTemperature
+}
+
+// crc16 is the Modbus CRC.
+func crc16(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// hysenRequest sends a Modbus request to a Hysen controller and returns the
+// Modbus response. The frames are prefixed with their length and followed
+// by a CRC.
+func (d *Device) hysenRequest(frame []byte) ([]byte, error) {
+	crc := crc16(frame)
+
+	payload := make([]byte, 16)
+	payload[0] = byte(len(frame) + 2)
+	copy(payload[2:], frame)
+	payload[2+len(frame)] = byte(crc)
+	payload[3+len(frame)] = byte(crc >> 8)
+
+	// The whole payload is needed, since it starts with the frame length.
+	resp, err := d.sessionRequest(unencryptedRequest{
+		command: 0x6a,
+		payload: payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(resp[0])
+	if n < 5 || n+2 > len(resp) {
+		return nil, fmt.Errorf("invalid response length %d", n)
+	}
+
+	crc = crc16(resp[2:n])
+	if resp[n] != byte(crc) || resp[n+1] != byte(crc>>8) {
+		return nil, errors.New("response checksum mismatch")
+	}
+
+	return resp[2:n], nil
+}
+
+// ThermostatStatus reads the state of a Hysen heating controller.
+func (d *Device) ThermostatStatus() (ThermostatStatus, error) {
+	resp, err := d.hysenRequest([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x16})
+	if err != nil {
+		return ThermostatStatus{}, fmt.Errorf("error making ThermostatStatus request: %v", err)
+	}
+
+	// Address, function and byte count, then the registers.
+	if len(resp) < 19 || resp[1] != 0x03 {
+		return ThermostatStatus{}, fmt.Errorf("unexpected ThermostatStatus response: % x", resp)
+	}
+
+	return ThermostatStatus{
+		Locked:              resp[3]&1 != 0,
+		Power:               resp[4]&1 != 0,
+		Heating:             (resp[4]>>4)&1 != 0,
+		Auto:                resp[7]&0x0f != 0,
+		Sensor:              int(resp[8]),
+		RoomTemperature:     float64(resp[5]) / 2,
+		TargetTemperature:   float64(resp[6]) / 2,
+		MaxTarget:           float64(resp[11]),
+		MinTarget:           float64(resp[12]),
+		ExternalTemperature: float64(resp[18]) / 2,
+		loopMode:            resp[7] >> 4,
+	}, nil
+}
+
+func (d *Device) hysenWrite(register byte, hi, lo byte) error {
+	_, err := d.hysenRequest([]byte{0x01, 0x06, 0x00, register, hi, lo})
+	return err
+}
+
+// SetThermostatPower switches a Hysen heating controller on or off, leaving
+// its lock as it is.
+func (d *Device) SetThermostatPower(on bool) error {
+	status, err := d.ThermostatStatus()
+	if err != nil {
+		return err
+	}
+
+	var lock, power byte
+	if status.Locked {
+		lock = 1
+	}
+	if on {
+		power = 1
+	}
+
+	err = d.hysenWrite(0x00, lock, power)
+	if err != nil {
+		return fmt.Errorf("error making SetThermostatPower request: %v", err)
+	}
+
+	return nil
+}
+
+// SetThermostatTarget sets the target temperature of a Hysen heating
+// controller, in steps of half a degree.
+func (d *Device) SetThermostatTarget(temp float64) error {
+	err := d.hysenWrite(0x01, 0x00, byte(temp*2+0.5))
+	if err != nil {
+		return fmt.Errorf("error making SetThermostatTarget request: %v", err)
+	}
+
+	return nil
+}
+
+// SetThermostatAuto switches a Hysen heating controller between following
+// its schedule and holding a manually set target.
+func (d *Device) SetThermostatAuto(auto bool) error {
+	status, err := d.ThermostatStatus()
+	if err != nil {
+		return err
+	}
+
+	mode := status.loopMode << 4
+	if auto {
+		mode |= 1
+	}
+
+	err = d.hysenWrite(0x02, mode, byte(status.Sensor))
+	if err != nil {
+		return fmt.Errorf("error making SetThermostatAuto request: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package broadlink
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+)
+
+// LevelTrace is below debug, and logs every packet sent and received.
+const LevelTrace = slog.LevelDebug - 4
+
+// commandAttr formats a packet's command byte for logging.
+func commandAttr(command byte) slog.Attr {
+	return slog.String("command", fmt.Sprintf("0x%02x", command))
+}
+
+// tracePacket logs a packet in hex, both as sent over the wire and
+// decrypted, if trace logging is enabled.
+func (d *Device) tracePacket(msg string, command byte, packet, payload []byte) {
+	ctx := context.Background()
+	if !d.log.Enabled(ctx, LevelTrace) {
+		return
+	}
+
+	d.log.LogAttrs(ctx, LevelTrace, msg,
+		commandAttr(command),
+		slog.String("packet", hex.EncodeToString(packet)),
+		slog.String("payload", hex.EncodeToString(payload)))
+}
@@ -0,0 +1,41 @@
+package broadlink
+
+// builtinModels are the models known to DefaultRegistry. 0x6026 is also sold
+// as the RM4 Pro Plus.
+var builtinModels = []Model{
+	{Type: 0x2737, Name: "Broadlink RM Mini", Supported: true, IR: true, RF: false, Power: false},
+	{Type: 0x27c2, Name: "Broadlink RM Mini 3", Supported: true, IR: true, RF: false, Power: false},
+	{Type: 0x5f36, Name: "Broadlink RM Mini 3 (RM4 update)", Supported: true, IR: true, RF: true, Power: false, RequestHeader: []byte{0x04, 0x00}, CodeSendingHeader: []byte{0xd0, 0x00}},
+	{Type: 0x273d, Name: "Broadlink RM Pro Phicom", Supported: true, IR: true, RF: false, Power: false},
+	{Type: 0x2712, Name: "Broadlink RM2", Supported: true, IR: true, RF: false, Power: false},
+	{Type: 0x2783, Name: "Broadlink RM2 Home Plus", Supported: true, IR: true, RF: false, Power: false},
+	{Type: 0x277c, Name: "Broadlink RM2 Home Plus GDT", Supported: true, IR: true, RF: false, Power: false},
+	{Type: 0x278f, Name: "Broadlink RM Mini Shate", Supported: true, IR: true, RF: false, Power: false},
+	{Type: 0x272a, Name: "Broadlink RM2 Pro Plus", Supported: true, IR: true, RF: true, Power: false},
+	{Type: 0x2787, Name: "Broadlink RM2 Pro Plus v2", Supported: true, IR: true, RF: true, Power: false},
+	{Type: 0x278b, Name: "Broadlink RM2 Pro Plus BL", Supported: true, IR: true, RF: true, Power: false},
+	{Type: 0x279d, Name: "Broadlink RM3 Pro Plus", Supported: true, IR: true, RF: true, Power: false},
+	{Type: 0x6026, Name: "Broadlink RM4 Pro V1", Supported: true, IR: true, RF: true, Power: false, RequestHeader: []byte{0x04, 0x00}, CodeSendingHeader: []byte{0xd0, 0x00}},
+	{Type: 0x61a2, Name: "Broadlink RM4 Pro V2", Supported: true, IR: true, RF: true, Power: false, RequestHeader: []byte{0x04, 0x00}, CodeSendingHeader: []byte{0xd0, 0x00}},
+	{Type: 0x649b, Name: "Broadlink RM4 Pro V3", Supported: true, IR: true, RF: true, Power: false, RequestHeader: []byte{0x04, 0x00}, CodeSendingHeader: []byte{0xd0, 0x00}},
+	{Type: 0x653c, Name: "Broadlink RM4 Pro V4", Supported: true, IR: true, RF: true, Power: false, RequestHeader: []byte{0x04, 0x00}, CodeSendingHeader: []byte{0xd0, 0x00}},
+	{Type: 0x27a9, Name: "Broadlink RM3 Pro Plus v2", Supported: true, IR: true, RF: true, Power: false},
+	{Type: 0, Name: "Broadlink SP1", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x2711, Name: "Broadlink SP2", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x2719, Name: "Honeywell SP2", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x7919, Name: "Honeywell SP2", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x271a, Name: "Honeywell SP2", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x791a, Name: "Honeywell SP2", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x2733, Name: "OEM Branded SP Mini", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x273e, Name: "OEM Branded SP Mini", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x2720, Name: "Broadlink SP Mini", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x753e, Name: "Broadlink SP 3", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x947a, Name: "Broadlink SP3S-US", Supported: true, IR: false, RF: false, Power: true, Energy: true},
+	{Type: 0x9479, Name: "Broadlink SP3S-EU", Supported: true, IR: false, RF: false, Power: true, Energy: true},
+	{Type: 0x2728, Name: "Broadlink SPMini 2", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x2736, Name: "Broadlink SPMini Plus", Supported: true, IR: false, RF: false, Power: true},
+	{Type: 0x2714, Name: "Broadlink A1", Supported: true, IR: false, RF: false, Power: false, Environment: true},
+	{Type: 0x4eb5, Name: "Broadlink MP1", Supported: true, IR: false, RF: false, Power: true, Sockets: MP1Sockets},
+	{Type: 0x2722, Name: "Broadlink S1 (SmartOne Alarm Kit)", Supported: false},
+	{Type: 0x4e4d, Name: "Dooya DT360E (DOOYA_CURTAIN_V2) or Hysen Heating Controller", Supported: true, IR: false, RF: false, Power: false, NeedsProbe: true},
+}
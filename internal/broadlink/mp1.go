@@ -0,0 +1,67 @@
+package broadlink
+
+import "fmt"
+
+// MP1Sockets is the number of sockets on an MP1 power strip.
+const MP1Sockets = 4
+
+// SetSocketPower switches one socket of an MP1, numbered from 1, leaving the
+// others as they are.
+func (d *Device) SetSocketPower(socket int, on bool) error {
+	if socket < 1 || socket > MP1Sockets {
+		return fmt.Errorf("invalid socket %d, expected 1 to %d", socket, MP1Sockets)
+	}
+
+	mask := byte(1 << uint(socket-1))
+
+	req := unencryptedRequest{
+		command: 0x6a,
+		payload: make([]byte, 16),
+	}
+	copy(req.payload, []byte{0x0d, 0x00, 0xa5, 0xa5, 0x5a, 0x5a, 0x00, 0xc0, 0x02, 0x00, 0x03})
+
+	// Byte 6 is a checksum over the mask and the new state.
+	req.payload[0x06] = 0xb2 + mask
+	req.payload[0x0d] = mask
+	if on {
+		req.payload[0x06] = 0xb2 + mask<<1
+		req.payload[0x0e] = mask
+	}
+
+	_, err := d.serverRequest(req)
+	if err != nil {
+		return fmt.Errorf("error making SetSocketPower request: %v", err)
+	}
+
+	return nil
+}
+
+// CheckSocketPower reports whether each socket of an MP1 is on, in socket
+// order.
+func (d *Device) CheckSocketPower() ([]bool, error) {
+	req := unencryptedRequest{
+		command: 0x6a,
+		payload: make([]byte, 16),
+	}
+	copy(req.payload, []byte{0x0a, 0x00, 0xa5, 0xa5, 0x5a, 0x5a, 0xae, 0xc0, 0x01})
+
+	resp, err := d.serverRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making CheckSocketPower request: %v", err)
+	}
+
+	if len(resp) < 0x0b {
+		return nil, fmt.Errorf("short CheckSocketPower response: %d bytes", len(resp))
+	}
+
+	// The state is at offset 0x0e of the payload, less the four bytes
+	// stripped by decryptResponse.
+	state := resp[0x0a]
+
+	sockets := make([]bool, MP1Sockets)
+	for i := range sockets {
+		sockets[i] = state&(1<<uint(i)) != 0
+	}
+
+	return sockets, nil
+}
@@ -0,0 +1,168 @@
+package broadlink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Offsets of the name and lock flag in hello responses.
+const (
+	helloNameOffset   = 0x40
+	helloLockedOffset = 0x7f
+)
+
+// maxNameLength is the longest name the name and lock payload holds.
+const maxNameLength = 0x3f
+
+// hello sends a discovery packet to the device alone and returns its
+// user-set name and whether it is locked, which only discovery replies
+// carry.
+func (d *Device) hello() (string, bool, error) {
+	d.reqMu.Lock()
+	defer d.reqMu.Unlock()
+
+	if d.sock == nil {
+		return "", false, errors.New("device is closed")
+	}
+
+	local := d.sock.conn.LocalAddr().(*net.UDPAddr)
+
+	packet := make([]byte, 0x30)
+	ip := local.IP.To4()
+	if ip == nil || ip.IsUnspecified() {
+		ip = d.outboundIP()
+	}
+	if ip != nil {
+		packet[0x18], packet[0x19], packet[0x1a], packet[0x1b] = ip[3], ip[2], ip[1], ip[0]
+	}
+	packet[0x1c] = byte(local.Port)
+	packet[0x1d] = byte(local.Port >> 8)
+	packet[0x26] = 0x06
+
+	checksum := 0xbeaf
+	for _, b := range packet {
+		checksum += int(b)
+	}
+	packet[0x20] = byte(checksum)
+	packet[0x21] = byte(checksum >> 8)
+
+	key := replyKey{ip: d.remoteAddr.String(), hello: true}
+	defer d.sock.forget(key)
+
+	for retries := 0; retries < sendRetries; retries++ {
+		replies, err := d.sock.expect(key)
+		if err != nil {
+			return "", false, err
+		}
+
+		_, err = d.sock.conn.WriteTo(packet, d.dest)
+		if err != nil {
+			return "", false, fmt.Errorf("could not send packet: %v", err)
+		}
+
+		var buf []byte
+		select {
+		case b, ok := <-replies:
+			if !ok {
+				return "", false, fmt.Errorf("error while waiting for hello response: %v", d.sock.failure())
+			}
+
+			buf = b
+		case <-time.After(time.Duration(d.timeout) * time.Second):
+			continue
+		}
+
+		if len(buf) <= helloLockedOffset {
+			return "", false, fmt.Errorf("short hello response: %d bytes", len(buf))
+		}
+
+		name := buf[helloNameOffset:helloLockedOffset]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+
+		return string(name), buf[helloLockedOffset] != 0, nil
+	}
+
+	return "", false, errors.New("error while waiting for hello response: timed out")
+}
+
+// outboundIP returns the local address the device is reached from, which
+// hello packets carry, or nil if there is no route to it.
+func (d *Device) outboundIP() net.IP {
+	// Connecting a UDP socket only picks a route; nothing is sent.
+	conn, err := net.DialUDP("udp4", nil, d.dest)
+	if err != nil {
+		return nil
+	}
+
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.To4()
+}
+
+// Ping checks that the device answers. It needs no session, so works even
+// once the device has forgotten ours.
+func (d *Device) Ping() error {
+	_, _, err := d.hello()
+	return err
+}
+
+// Name returns the name given to the device in the vendor app or by
+// SetName.
+func (d *Device) Name() (string, error) {
+	name, _, err := d.hello()
+	return name, err
+}
+
+// Locked reports whether the device is locked against local control.
+func (d *Device) Locked() (bool, error) {
+	_, locked, err := d.hello()
+	return locked, err
+}
+
+// SetName renames the device, leaving its lock as it is.
+func (d *Device) SetName(name string) error {
+	_, locked, err := d.hello()
+	if err != nil {
+		return err
+	}
+
+	return d.setNameLock(name, locked)
+}
+
+// SetLock locks or unlocks the device, keeping its name. A locked device
+// refuses to authenticate new local clients.
+func (d *Device) SetLock(locked bool) error {
+	name, _, err := d.hello()
+	if err != nil {
+		return err
+	}
+
+	return d.setNameLock(name, locked)
+}
+
+func (d *Device) setNameLock(name string, locked bool) error {
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name must be at most %d bytes long", maxNameLength)
+	}
+
+	req := unencryptedRequest{
+		command: 0x6a,
+		payload: make([]byte, 0x50),
+	}
+	copy(req.payload[4:], name)
+	if locked {
+		req.payload[0x43] = 1
+	}
+
+	_, err := d.serverRequest(req)
+	if err != nil {
+		return fmt.Errorf("error making SetName request: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package broadlink
+
+import (
+	"errors"
+	"time"
+)
+
+// Result is how a request to a device turned out.
+type Result string
+
+const (
+	ResultOK          Result = "ok"
+	ResultTimeout     Result = "timeout"
+	ResultDeviceError Result = "device_error"
+	ResultError       Result = "error"
+)
+
+func resultOf(err error) Result {
+	var serr *StatusError
+	switch {
+	case err == nil:
+		return ResultOK
+	case err == errTimeout:
+		return ResultTimeout
+	case errors.As(err, &serr):
+		return ResultDeviceError
+	default:
+		return ResultError
+	}
+}
+
+// Observer is told about a device's requests, e.g. to export metrics. Its
+// methods may be called with the device's request lock held, so must not
+// call back into the device.
+type Observer interface {
+	// Request is called once a request completes, with its command byte.
+	Request(command byte, result Result, latency time.Duration)
+
+	// Retry is called when a packet has to be sent again.
+	Retry(command byte)
+
+	// Reauth is called when the device has to be authenticated again.
+	Reauth()
+}
@@ -0,0 +1,156 @@
+package broadlink
+
+import "fmt"
+
+// Relay and nightlight bits of the SP2 state byte.
+const (
+	powerBit      = 0x01
+	nightlightBit = 0x02
+)
+
+// isSP1 reports whether the device is an original SP1, which uses its own
+// command and cannot report its state.
+func (d *Device) isSP1() bool {
+	return d.model.Type == 0
+}
+
+// SetPower switches the relay of a smart plug, leaving the nightlight as it
+// is.
+func (d *Device) SetPower(on bool) error {
+	if d.isSP1() {
+		req := unencryptedRequest{
+			command: 0x66,
+			payload: make([]byte, 16),
+		}
+
+		if on {
+			req.payload[0] = 1
+		}
+
+		_, err := d.serverRequest(req)
+		if err != nil {
+			return fmt.Errorf("error making SetPower request: %v", err)
+		}
+
+		return nil
+	}
+
+	state, err := d.checkState()
+	if err != nil {
+		return err
+	}
+
+	state &^= powerBit
+	if on {
+		state |= powerBit
+	}
+
+	return d.setState(state)
+}
+
+// CheckPower reports whether the relay of a smart plug is on.
+func (d *Device) CheckPower() (bool, error) {
+	state, err := d.checkState()
+	if err != nil {
+		return false, err
+	}
+
+	return state&powerBit != 0, nil
+}
+
+// SetNightlight switches the nightlight of an SP2 or SP3, leaving the relay
+// as it is.
+func (d *Device) SetNightlight(on bool) error {
+	state, err := d.checkState()
+	if err != nil {
+		return err
+	}
+
+	state &^= nightlightBit
+	if on {
+		state |= nightlightBit
+	}
+
+	return d.setState(state)
+}
+
+// CheckNightlight reports whether the nightlight of an SP2 or SP3 is on.
+func (d *Device) CheckNightlight() (bool, error) {
+	state, err := d.checkState()
+	if err != nil {
+		return false, err
+	}
+
+	return state&nightlightBit != 0, nil
+}
+
+// MeasuresEnergy reports whether the device is a metering plug which
+// supports CheckEnergy.
+func (d *Device) MeasuresEnergy() bool {
+	return d.model.Energy
+}
+
+// CheckEnergy returns the power drawn through a metering plug such as the
+// SP3S, in watts.
+func (d *Device) CheckEnergy() (float64, error) {
+	req := unencryptedRequest{
+		command: 0x6a,
+		payload: make([]byte, 16),
+	}
+	copy(req.payload, []byte{0x08, 0x00, 0xfe, 0x01, 0x05, 0x01, 0x00, 0x00, 0x00, 0x2d})
+
+	resp, err := d.serverRequest(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making CheckEnergy request: %v", err)
+	}
+
+	if len(resp) < 4 {
+		return 0, fmt.Errorf("short CheckEnergy response: %d bytes", len(resp))
+	}
+
+	// The reading is in hundredths of a watt, as BCD, most significant
+	// byte last.
+	energy := 0
+	for _, b := range []byte{resp[3], resp[2], resp[1]} {
+		energy = energy*100 + int(b>>4)*10 + int(b&0x0f)
+	}
+
+	return float64(energy) / 100.0, nil
+}
+
+func (d *Device) checkState() (byte, error) {
+	if d.isSP1() {
+		return 0, fmt.Errorf("the SP1 cannot report its state")
+	}
+
+	req := unencryptedRequest{
+		command: 0x6a,
+		payload: make([]byte, 16),
+	}
+	req.payload[0] = 0x01
+
+	resp, err := d.serverRequest(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making CheckPower request: %v", err)
+	}
+
+	// Some firmware sets the unused bits too, e.g. 0xfd for on with the
+	// nightlight off.
+	return resp[0] & (powerBit | nightlightBit), nil
+}
+
+func (d *Device) setState(state byte) error {
+	req := unencryptedRequest{
+		command: 0x6a,
+		payload: make([]byte, 16),
+	}
+	req.payload[0] = 0x02
+	req.payload[4] = state
+
+	_, err := d.serverRequest(req)
+	if err != nil {
+		return fmt.Errorf("error making SetPower request: %v", err)
+	}
+
+	return nil
+}
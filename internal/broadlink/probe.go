@@ -0,0 +1,55 @@
+package broadlink
+
+import "fmt"
+
+// Product identifies which of the products sharing a device type a device
+// is.
+type Product int
+
+// Products told apart by Probe.
+const (
+	ProductUnknown Product = iota
+	ProductHysen
+	ProductDooya
+)
+
+func (p Product) String() string {
+	switch p {
+	case ProductHysen:
+		return "Hysen heating controller"
+	case ProductDooya:
+		return "Dooya curtain motor"
+	default:
+		return "unknown product"
+	}
+}
+
+// NeedsProbe reports whether the device's type is shared by several
+// products, so that Probe is needed to tell which this is.
+func (d *Device) NeedsProbe() bool {
+	return d.model.NeedsProbe
+}
+
+// Probe queries the device to find out which product it is. Hysen
+// controllers answer a Modbus status read with a valid checksum, which a
+// Dooya motor does not, so the Hysen is tried first. The result is
+// remembered.
+func (d *Device) Probe() (Product, error) {
+	if d.product != ProductUnknown {
+		return d.product, nil
+	}
+
+	_, err := d.ThermostatStatus()
+	if err == nil {
+		d.product = ProductHysen
+		return d.product, nil
+	}
+
+	pos, err := d.CurtainPosition()
+	if err == nil && pos <= 100 {
+		d.product = ProductDooya
+		return d.product, nil
+	}
+
+	return ProductUnknown, fmt.Errorf("device type 0x%04x did not answer as a Hysen or Dooya device", d.model.Type)
+}
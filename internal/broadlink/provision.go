@@ -0,0 +1,97 @@
+package broadlink
+
+import (
+	"fmt"
+	"net"
+)
+
+// Security is the Wi-Fi security mode given to Provision.
+type Security byte
+
+// Security modes understood by devices in setup mode.
+const (
+	SecurityNone Security = iota
+	SecurityWEP
+	SecurityWPA1
+	SecurityWPA2
+	SecurityWPA1WPA2
+)
+
+// ParseSecurity parses a security mode name: none, wep, wpa1, wpa2 or
+// wpa1/2.
+func ParseSecurity(s string) (Security, error) {
+	switch s {
+	case "none":
+		return SecurityNone, nil
+	case "wep":
+		return SecurityWEP, nil
+	case "wpa1", "wpa":
+		return SecurityWPA1, nil
+	case "wpa2":
+		return SecurityWPA2, nil
+	case "wpa1/2", "wpa1wpa2":
+		return SecurityWPA1WPA2, nil
+	default:
+		return 0, fmt.Errorf("unknown security mode %q, expected none, wep, wpa1, wpa2 or wpa1/2", s)
+	}
+}
+
+// Lengths of the SSID and password fields of the join packet.
+const (
+	maxSSIDLength     = 32
+	maxPasswordLength = 32
+)
+
+// Provision broadcasts the join packet to a factory reset device in setup
+// mode, telling it to join the given network. The device acknowledges
+// nothing; it drops its own access point and joins the network if the
+// details are right. Unlike the vendor app, this leaves the device
+// unlocked.
+func Provision(ssid, password string, security Security) error {
+	return ProvisionAt(net.IPv4bcast, ssid, password, security)
+}
+
+// ProvisionAt is Provision sent to a single address, such as 192.168.10.1
+// when connected to the device's own access point.
+func ProvisionAt(ip net.IP, ssid, password string, security Security) error {
+	if len(ssid) == 0 || len(ssid) > maxSSIDLength {
+		return fmt.Errorf("ssid must be 1 to %d bytes long", maxSSIDLength)
+	}
+
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes long", maxPasswordLength)
+	}
+
+	if security > SecurityWPA1WPA2 {
+		return fmt.Errorf("invalid security mode %d", security)
+	}
+
+	packet := make([]byte, 0x88)
+	packet[0x26] = 0x14
+	copy(packet[0x44:], ssid)
+	copy(packet[0x64:], password)
+	packet[0x84] = byte(len(ssid))
+	packet[0x85] = byte(len(password))
+	packet[0x86] = byte(security)
+
+	checksum := 0xbeaf
+	for _, b := range packet {
+		checksum += int(b)
+	}
+	packet[0x20] = byte(checksum)
+	packet[0x21] = byte(checksum >> 8)
+
+	conn, err := net.ListenPacket("udp4", "")
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.WriteTo(packet, &net.UDPAddr{IP: ip, Port: 80})
+	if err != nil {
+		return fmt.Errorf("error sending join packet: %v", err)
+	}
+
+	return nil
+}
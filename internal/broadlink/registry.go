@@ -0,0 +1,207 @@
+package broadlink
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Header is a byte prefix in a model's requests, written as hex in model
+// files.
+type Header []byte
+
+func (h *Header) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid header %q: %v", text, err)
+	}
+
+	*h = b
+	return nil
+}
+
+func (h Header) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+// Model describes a device model: what it can do and how to talk to it.
+type Model struct {
+	Type      int    `json:"type"`
+	Name      string `json:"name"`
+	Supported bool   `json:"supported"`
+	IR        bool   `json:"ir,omitempty"`
+	RF        bool   `json:"rf,omitempty"`
+	Power     bool   `json:"power,omitempty"`
+	Energy    bool   `json:"energy,omitempty"`
+	// Environment marks an A1, which reports temperature, humidity,
+	// light, air quality and noise.
+	Environment bool `json:"environment,omitempty"`
+	// Sockets is the number of separately switched sockets of a power
+	// strip such as the MP1, and zero for other models.
+	Sockets int `json:"sockets,omitempty"`
+	// NeedsProbe marks a type shared by several products, which
+	// Device.Probe tells apart.
+	NeedsProbe bool `json:"needsProbe,omitempty"`
+
+	// RequestHeader prefixes basic requests, and CodeSendingHeader the
+	// requests which send a code. Models with a request header prefix
+	// their responses with a length.
+	RequestHeader     Header `json:"requestHeader,omitempty"`
+	CodeSendingHeader Header `json:"codeSendingHeader,omitempty"`
+
+	// SensorScale divides the fractional byte of temperature and humidity
+	// readings. Zero means 100.
+	SensorScale int `json:"sensorScale,omitempty"`
+
+	// DecodeSensors, if set, replaces the decoding of CheckSensors
+	// responses.
+	DecodeSensors func(resp []byte) (temperature, humidity float64, err error) `json:"-"`
+
+	// TrimResponse, if set, replaces the stripping of the header and
+	// padding from decrypted responses.
+	TrimResponse func(payload []byte) []byte `json:"-"`
+}
+
+// Registry maps type codes to device models.
+type Registry struct {
+	mu     sync.RWMutex
+	models map[int]Model
+}
+
+// NewRegistry returns a registry of the given models, which must have
+// distinct types.
+func NewRegistry(models ...Model) (*Registry, error) {
+	r := &Registry{models: make(map[int]Model)}
+
+	for _, m := range models {
+		err := r.Add(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// DefaultRegistry holds the models built into this package and is used by
+// NewDevice.
+var DefaultRegistry = mustRegistry(builtinModels...)
+
+func mustRegistry(models ...Model) *Registry {
+	r, err := NewRegistry(models...)
+	if err != nil {
+		panic(err)
+	}
+
+	return r
+}
+
+// Add registers a model, failing if its type is already registered.
+func (r *Registry) Add(m Model) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cur, ok := r.models[m.Type]; ok {
+		return fmt.Errorf("type 0x%04x is already registered as %q", m.Type, cur.Name)
+	}
+
+	r.models[m.Type] = m
+	return nil
+}
+
+// Set registers a model, replacing any with the same type.
+func (r *Registry) Set(m Model) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.models[m.Type] = m
+}
+
+// Lookup returns the model with the given type.
+func (r *Registry) Lookup(deviceType int) (Model, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.models[deviceType]
+	return m, ok
+}
+
+// Models returns the registered models in type order.
+func (r *Registry) Models() []Model {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	models := make([]Model, 0, len(r.models))
+	for _, m := range r.models {
+		models = append(models, m)
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Type < models[j].Type
+	})
+
+	return models
+}
+
+// LoadFile registers the models in a JSON file holding an array of models,
+// replacing any with the same types. Models in the file are supported unless
+// they say otherwise.
+func (r *Registry) LoadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw []json.RawMessage
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	models := make([]Model, len(raw))
+	types := make(map[int]bool)
+	for i, rm := range raw {
+		models[i].Supported = true
+
+		err = json.Unmarshal(rm, &models[i])
+		if err != nil {
+			return fmt.Errorf("error parsing model %d of %s: %v", i, path, err)
+		}
+
+		// 0 is the SP1, so a model without a type would silently
+		// replace it.
+		if models[i].Type <= 0 {
+			return fmt.Errorf("model %d of %s has no type", i, path)
+		}
+
+		if models[i].Name == "" {
+			return fmt.Errorf("model %d of %s has no name", i, path)
+		}
+
+		if types[models[i].Type] {
+			return fmt.Errorf("duplicate model type 0x%04x in %s", models[i].Type, path)
+		}
+
+		types[models[i].Type] = true
+	}
+
+	for _, m := range models {
+		r.Set(m)
+	}
+
+	return nil
+}
+
+// NewDevice connects to a device of a model in the registry.
+func (r *Registry) NewDevice(ip net.IP, mac net.HardwareAddr, deviceType int, opts ...Option) (*Device, error) {
+	m, ok := r.Lookup(deviceType)
+	if !ok || !m.Supported {
+		return nil, fmt.Errorf("device type %v (0x%04x) is not supported", deviceType, deviceType)
+	}
+
+	return newDevice(ip, mac, defaultTimeout, m, opts...)
+}
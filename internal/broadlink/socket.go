@@ -0,0 +1,191 @@
+package broadlink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// replyKey identifies the request a packet answers: the device it came
+// from and either the packet count it echoes or, for hello replies, which
+// carry no count, the hello flag.
+type replyKey struct {
+	ip    string
+	hello bool
+	count uint16
+}
+
+// socket is a long-lived UDP socket with a reader goroutine which hands each
+// reply to the request waiting for it. Sockets bound to a fixed local
+// address are shared by every device using that address.
+type socket struct {
+	conn  net.PacketConn
+	local string
+
+	mu      sync.Mutex
+	pending map[replyKey]chan []byte
+	refs    int
+	err     error
+}
+
+var (
+	sharedMu      sync.Mutex
+	sharedSockets = make(map[string]*socket)
+)
+
+// openSocket returns a socket bound to local, or to an ephemeral port if
+// local is empty. Each call must be matched by a call to release.
+func openSocket(local string) (*socket, error) {
+	if local == "" {
+		s, err := listen("")
+		if err != nil {
+			return nil, err
+		}
+
+		s.refs = 1
+		return s, nil
+	}
+
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	s := sharedSockets[local]
+	if s == nil {
+		var err error
+		s, err = listen(local)
+		if err != nil {
+			return nil, err
+		}
+
+		sharedSockets[local] = s
+	}
+
+	s.mu.Lock()
+	s.refs++
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+func listen(local string) (*socket, error) {
+	conn, err := net.ListenPacket("udp4", local)
+	if err != nil {
+		return nil, fmt.Errorf("error binding %q: %v", local, err)
+	}
+
+	s := &socket{
+		conn:    conn,
+		local:   local,
+		pending: make(map[replyKey]chan []byte),
+	}
+
+	go s.read()
+
+	return s, nil
+}
+
+// release drops a reference to the socket, closing it with the last.
+func (s *socket) release() {
+	if s.local != "" {
+		sharedMu.Lock()
+		defer sharedMu.Unlock()
+	}
+
+	s.mu.Lock()
+	s.refs--
+	last := s.refs == 0
+	s.mu.Unlock()
+
+	if !last {
+		return
+	}
+
+	if s.local != "" {
+		delete(sharedSockets, s.local)
+	}
+
+	s.conn.Close()
+}
+
+// expect registers interest in the reply with the given key. The channel
+// receives the reply, or is closed if the socket fails.
+func (s *socket) expect(key replyKey) (chan []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	ch := make(chan []byte, 1)
+	s.pending[key] = ch
+
+	return ch, nil
+}
+
+// forget drops interest in a reply which is no longer awaited.
+func (s *socket) forget(key replyKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, key)
+}
+
+func (s *socket) read() {
+	for {
+		buf := make([]byte, 2048)
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || n < 0x30 {
+			continue
+		}
+
+		key := replyKey{ip: addr.IP.String()}
+		if buf[0x26] == 0x07 {
+			key.hello = true
+		} else {
+			key.count = uint16(buf[0x28]) | uint16(buf[0x29])<<8
+		}
+
+		s.mu.Lock()
+		ch := s.pending[key]
+		delete(s.pending, key)
+		s.mu.Unlock()
+
+		// Replies nobody is waiting for are late answers to requests which
+		// timed out.
+		if ch != nil {
+			ch <- buf[:n]
+		}
+	}
+}
+
+// failure returns why the socket stopped reading.
+func (s *socket) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// fail wakes every waiting request once the socket can no longer read.
+func (s *socket) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = errors.New("socket closed")
+	if !errors.Is(err, net.ErrClosed) {
+		s.err = fmt.Errorf("error reading from socket: %v", err)
+	}
+
+	for key, ch := range s.pending {
+		close(ch)
+		delete(s.pending, key)
+	}
+}